@@ -0,0 +1,289 @@
+// Copyright 2017 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-policy-agent/kube-mgmt/pkg/data"
+	"github.com/open-policy-agent/kube-mgmt/pkg/opa"
+	"github.com/open-policy-agent/kube-mgmt/pkg/types"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// Cluster API stores the kubeconfig of each cluster in a Secret named
+// <cluster>-kubeconfig, labelled with the name of the cluster.
+const (
+	clusterNameLabel    = "cluster.x-k8s.io/cluster-name"
+	kubeconfigSecretKey = "value"
+	kubeconfigSuffix    = "-kubeconfig"
+)
+
+// The min/max amount of time to wait before retrying to start replicating
+// from a remote cluster.
+const (
+	clusterBackoffMin = time.Second
+	clusterBackoffMax = time.Minute * 5
+)
+
+// remoteCluster replicates the same resources as the local cluster from
+// another cluster, into <replicate-path>/<name>. Each remote cluster is
+// started, and retried, on its own, so that an unreachable cluster does
+// not hold up the others.
+type remoteCluster struct {
+	name       string
+	kubeconfig *rest.Config
+	backoffMin time.Duration
+	backoffMax time.Duration
+
+	mu    sync.Mutex
+	syncs []*data.GenericSync // nil until replication started
+}
+
+func newRemoteCluster(name string, kubeconfig []byte) (*remoteCluster, error) {
+	if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid cluster name %q: %v", name, strings.Join(errs, ", "))
+	}
+	raw, err := clientcmd.Load(kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid kubeconfig for cluster %v: %w", name, err)
+	}
+	if err := checkCredentials(raw); err != nil {
+		return nil, fmt.Errorf("invalid kubeconfig for cluster %v: %w", name, err)
+	}
+	config, err := clientcmd.NewDefaultClientConfig(*raw, &clientcmd.ConfigOverrides{}).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("invalid kubeconfig for cluster %v: %w", name, err)
+	}
+	return &remoteCluster{
+		name:       name,
+		kubeconfig: config,
+		backoffMin: clusterBackoffMin,
+		backoffMax: clusterBackoffMax,
+	}, nil
+}
+
+// checkCredentials refuses the kubeconfigs that run commands or read files
+// to authenticate, as their credentials are expected to be inline.
+func checkCredentials(config *clientcmdapi.Config) error {
+	for name, cluster := range config.Clusters {
+		if cluster.CertificateAuthority != "" {
+			return fmt.Errorf("cluster %q reads its certificate authority from a file", name)
+		}
+	}
+	for name, user := range config.AuthInfos {
+		switch {
+		case user.Exec != nil:
+			return fmt.Errorf("user %q authenticates with a command", name)
+		case user.AuthProvider != nil:
+			return fmt.Errorf("user %q authenticates with an auth provider", name)
+		case user.TokenFile != "" || user.ClientCertificate != "" || user.ClientKey != "":
+			return fmt.Errorf("user %q reads its credentials from files", name)
+		}
+	}
+	return nil
+}
+
+// loadRemoteClusters loads the kubeconfigs of the remote clusters from
+// --remote-kubeconfig-dir and --remote-kubeconfig-namespace. Clusters are
+// replicated next to the local resources, so their names must differ, also
+// from those of the resources that may be replicated dynamically.
+func loadRemoteClusters(params *params, client kubernetes.Interface, local []replication) ([]*remoteCluster, error) {
+	var clusters []*remoteCluster
+	if params.remoteKubeconfigDir != "" {
+		fromDir, err := loadKubeconfigDir(params.remoteKubeconfigDir)
+		if err != nil {
+			return nil, err
+		}
+		clusters = append(clusters, fromDir...)
+	}
+	if params.remoteKubeconfigNs != "" {
+		fromSecrets, err := loadKubeconfigSecrets(client, params.remoteKubeconfigNs)
+		if err != nil {
+			return nil, err
+		}
+		clusters = append(clusters, fromSecrets...)
+	}
+
+	seen := map[string]struct{}{data.IndexPath: {}}
+	for _, r := range local {
+		seen[r.resourceType.Resource] = struct{}{}
+	}
+	for _, c := range clusters {
+		if _, ok := seen[c.name]; ok {
+			return nil, fmt.Errorf("cluster %v is configured more than once, or named like a replicated resource", c.name)
+		}
+		seen[c.name] = struct{}{}
+	}
+
+	if len(clusters) > 0 && (params.opaConfigFile != "" || params.analysisPolicyDir != "") {
+		rts, err := expandWildcard(client.Discovery(), groupVersionKind{Kind: "*"})
+		if err != nil {
+			return nil, err
+		}
+		for _, rt := range rts {
+			if _, ok := seen[rt.Resource]; ok {
+				return nil, fmt.Errorf("cluster %v is named like resource %v, which may be replicated dynamically", rt.Resource, rt)
+			}
+		}
+	}
+	return clusters, nil
+}
+
+// loadKubeconfigDir loads a cluster from each file in the directory, named
+// after the file without its extension, e.g. prod for prod.yaml.
+func loadKubeconfigDir(path string) ([]*remoteCluster, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var clusters []*remoteCluster
+	for _, entry := range entries {
+		// Skip hidden files, e.g. the ..data symlink of mounted Secrets
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		file := filepath.Join(path, entry.Name())
+		info, err := os.Stat(file) // follows symlinks
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			continue
+		}
+		bs, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+		c, err := newRemoteCluster(name, bs)
+		if err != nil {
+			return nil, err
+		}
+		clusters = append(clusters, c)
+	}
+	return clusters, nil
+}
+
+// loadKubeconfigSecrets loads a cluster from each kubeconfig Secret of
+// Cluster API in the namespace.
+func loadKubeconfigSecrets(client kubernetes.Interface, namespace string) ([]*remoteCluster, error) {
+	secrets, err := client.CoreV1().Secrets(namespace).List(context.Background(), metav1.ListOptions{LabelSelector: clusterNameLabel})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list kubeconfig secrets: %w", err)
+	}
+	var clusters []*remoteCluster
+	for _, secret := range secrets.Items {
+		name := secret.Labels[clusterNameLabel]
+		if secret.Name != name+kubeconfigSuffix { // e.g. <cluster>-user-kubeconfig
+			continue
+		}
+		bs, ok := secret.Data[kubeconfigSecretKey]
+		if !ok {
+			logrus.Warnf("Skipping secret %v/%v without %v key", secret.Namespace, secret.Name, kubeconfigSecretKey)
+			continue
+		}
+		c, err := newRemoteCluster(name, bs)
+		if err != nil {
+			return nil, fmt.Errorf("secret %v/%v: %w", secret.Namespace, secret.Name, err)
+		}
+		clusters = append(clusters, c)
+	}
+	return clusters, nil
+}
+
+// run starts replicating from the cluster, retrying with backoff until it
+// succeeds, and replicates until the context is done.
+func (c *remoteCluster) run(ctx context.Context, params *params, local kubernetes.Interface) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	delay := c.backoffMin
+	for {
+		err := c.start(ctx, &wg, params, local)
+		if err == nil {
+			logrus.Infof("Replicating from cluster %v", c.name)
+			return
+		}
+		logrus.Warnf("Failed to replicate from cluster %v (will retry after %v): %v", c.name, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		delay = min(delay*2, c.backoffMax)
+	}
+}
+
+// start resolves the resources to replicate through the discovery of the
+// cluster, and starts their replication.
+func (c *remoteCluster) start(ctx context.Context, wg *sync.WaitGroup, params *params, local kubernetes.Interface) error {
+	client, err := kubernetes.NewForConfig(c.kubeconfig)
+	if err != nil {
+		return err
+	}
+	replications, err := getReplications(params, local, client.Discovery())
+	if err != nil {
+		return err
+	}
+
+	target := opa.New(params.opaURL, params.opaAuth).Prefix(params.replicatePath).Prefix(c.name)
+	if params.replicateCleanup {
+		rts := make([]types.ResourceType, 0, len(replications))
+		for _, r := range replications {
+			rts = append(rts, r.resourceType)
+		}
+		removeStaleData(ctx, target, rts)
+	}
+
+	// Informers are shared by the replications of this cluster only
+	opts := append([]data.Option{
+		data.WithIgnoreNamespaces(params.replicateIgnoreNs),
+		data.WithInformers(data.NewInformers()),
+	}, replicateOptions(params)...)
+	syncs, err := startReplications(ctx, wg, c.kubeconfig, target, replications, opts)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.syncs = syncs
+	return nil
+}
+
+// replications returns the replications of the cluster, none until they
+// are started.
+func (c *remoteCluster) replications() []*data.GenericSync {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.syncs
+}
+
+// Ready returns true once all the resources of the cluster are replicated.
+func (c *remoteCluster) Ready() bool {
+	syncs := c.replications()
+	if syncs == nil {
+		return false
+	}
+	for _, s := range syncs {
+		if !s.Ready() {
+			return false
+		}
+	}
+	return true
+}
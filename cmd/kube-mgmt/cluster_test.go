@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/open-policy-agent/kube-mgmt/pkg/types"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func kubeconfig(server string) string {
+	return `
+apiVersion: v1
+kind: Config
+clusters:
+- name: remote
+  cluster: {server: "` + server + `"}
+contexts:
+- name: remote
+  context: {cluster: remote, user: remote}
+current-context: remote
+users:
+- name: remote
+  user: {token: secret}
+`
+}
+
+func kubeconfigSecret(name, cluster, config string) *apiv1.Secret {
+	return &apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "clusters",
+			Name:      name,
+			Labels:    map[string]string{clusterNameLabel: cluster},
+		},
+		Data: map[string][]byte{kubeconfigSecretKey: []byte(config)},
+	}
+}
+
+func writeKubeconfigDir(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadRemoteClusters(t *testing.T) {
+	dir := writeKubeconfigDir(t, map[string]string{
+		"prod.yaml":         kubeconfig("https://prod.example.com"),
+		"staging":           kubeconfig("https://staging.example.com"),
+		".hidden":           "not a kubeconfig",
+		"..data/prod.yaml":  "not a kubeconfig",
+		"nested/other.yaml": "not a kubeconfig",
+	})
+	client := fake.NewSimpleClientset(
+		kubeconfigSecret("edge-kubeconfig", "edge", kubeconfig("https://edge.example.com")),
+		kubeconfigSecret("edge-ca", "edge", "not a kubeconfig"),
+		kubeconfigSecret("edge-user-kubeconfig", "edge", "not a kubeconfig"),
+		&apiv1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "clusters", Name: "other-kubeconfig"}},
+	)
+
+	params := &params{remoteKubeconfigDir: dir, remoteKubeconfigNs: "clusters"}
+	clusters, err := loadRemoteClusters(params, client, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var names, hosts []string
+	for _, c := range clusters {
+		names = append(names, c.name)
+		hosts = append(hosts, c.kubeconfig.Host)
+	}
+	expectedNames := []string{"prod", "staging", "edge"}
+	expectedHosts := []string{"https://prod.example.com", "https://staging.example.com", "https://edge.example.com"}
+	if !reflect.DeepEqual(expectedNames, names) || !reflect.DeepEqual(expectedHosts, hosts) {
+		t.Fatalf("Expected %v at %v but got: %v at %v", expectedNames, expectedHosts, names, hosts)
+	}
+}
+
+func TestLoadRemoteClustersErrors(t *testing.T) {
+	pods := []replication{{resourceType: types.ResourceType{Namespaced: true, Version: "v1", Resource: "pods"}}}
+	tests := map[string]struct {
+		files   map[string]string
+		secrets []*apiv1.Secret
+		dynamic bool
+	}{
+		"bad kubeconfig": {files: map[string]string{"prod": "{"}},
+		"exec credentials": {files: map[string]string{
+			"prod": strings.Replace(kubeconfig("https://prod.example.com"), "{token: secret}", "{exec: {apiVersion: client.authentication.k8s.io/v1, command: get-token, interactiveMode: Never}}", 1),
+		}},
+		"auth provider": {files: map[string]string{
+			"prod": strings.Replace(kubeconfig("https://prod.example.com"), "{token: secret}", "{auth-provider: {name: oidc}}", 1),
+		}},
+		"token file": {secrets: []*apiv1.Secret{kubeconfigSecret("prod-kubeconfig", "prod",
+			strings.Replace(kubeconfig("https://prod.example.com"), "{token: secret}", "{tokenFile: cluster_test.go}", 1),
+		)}},
+		"certificate files": {secrets: []*apiv1.Secret{kubeconfigSecret("prod-kubeconfig", "prod",
+			strings.Replace(kubeconfig("https://prod.example.com"), "{token: secret}", "{client-certificate: cluster_test.go, client-key: cluster_test.go}", 1),
+		)}},
+		"certificate authority file": {files: map[string]string{
+			"prod": strings.Replace(kubeconfig("https://prod.example.com"), "{server:", "{certificate-authority: cluster_test.go, server:", 1),
+		}},
+		"dynamic resource name": {
+			files:   map[string]string{"nodes": kubeconfig("https://prod.example.com")},
+			dynamic: true,
+		},
+		"bad name":      {files: map[string]string{"Prod_1.yaml": kubeconfig("https://prod.example.com")}},
+		"resource name": {files: map[string]string{"pods": kubeconfig("https://prod.example.com")}},
+		"duplicate": {
+			files:   map[string]string{"prod": kubeconfig("https://prod.example.com")},
+			secrets: []*apiv1.Secret{kubeconfigSecret("prod-kubeconfig", "prod", kubeconfig("https://prod.example.com"))},
+		},
+		"bad secret": {
+			secrets: []*apiv1.Secret{kubeconfigSecret("prod-kubeconfig", "prod", "{")},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			client := withResources(fake.NewSimpleClientset(), coreResources...)
+			for _, secret := range tc.secrets {
+				if _, err := client.CoreV1().Secrets(secret.Namespace).Create(context.Background(), secret, metav1.CreateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			params := &params{remoteKubeconfigDir: writeKubeconfigDir(t, tc.files), remoteKubeconfigNs: "clusters"}
+			if tc.dynamic {
+				params.analysisPolicyDir = t.TempDir()
+			}
+			if _, err := loadRemoteClusters(params, client, pods); err == nil {
+				t.Fatalf("Expected error")
+			}
+		})
+	}
+}
+
+func TestRemoteClusterBackoff(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	c, err := newRemoteCluster("prod", []byte(kubeconfig(server.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.backoffMin = time.Millisecond
+	c.backoffMax = time.Millisecond * 10
+
+	params := &params{replicatePath: "kubernetes"}
+	if err := params.replicateResource.Set("pods"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.run(ctx, params, fake.NewSimpleClientset())
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for requests.Load() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected replication from the cluster to be retried")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if c.Ready() {
+		t.Fatalf("Expected cluster not to be ready")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected run to return once the context is done")
+	}
+}
+
+// newRemoteServer serves the discovery, list and watch of pods of a remote
+// cluster, and the data API of OPA, recording the paths written to.
+func newRemoteServer(t *testing.T, written chan<- string) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	serveJSON := func(path, body string) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(body))
+		})
+	}
+	serveJSON("/api", `{"kind": "APIVersions", "versions": ["v1"]}`)
+	serveJSON("/apis", `{"kind": "APIGroupList", "groups": []}`)
+	serveJSON("/api/v1", `{"kind": "APIResourceList", "groupVersion": "v1", "resources": [
+		{"name": "pods", "singularName": "pod", "kind": "Pod", "namespaced": true, "verbs": ["list", "watch"]}]}`)
+	mux.HandleFunc("/api/v1/pods", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("watch") == "true" {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		w.Write([]byte(`{"kind": "PodList", "apiVersion": "v1", "metadata": {"resourceVersion": "1"}, "items": []}`))
+	})
+	mux.HandleFunc("/v1/data/", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case written <- strings.TrimPrefix(r.URL.Path, "/v1/data"):
+		default:
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRemoteClusterReplicate(t *testing.T) {
+	written := make(chan string, 10)
+	server := newRemoteServer(t, written)
+
+	c, err := newRemoteCluster("prod", []byte(kubeconfig(server.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Ready() {
+		t.Fatalf("Expected cluster not to be ready before replication starts")
+	}
+
+	params := &params{replicatePath: "kubernetes", opaURL: server.URL + "/v1"}
+	if err := params.replicateResource.Set("pod"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.run(ctx, params, fake.NewSimpleClientset())
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	select {
+	case path := <-written:
+		if path != "/kubernetes/prod/pods" {
+			t.Fatalf("Expected pods to be replicated into /kubernetes/prod/pods but got: %v", path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected pods to be replicated")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !c.Ready() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected cluster to be ready")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2017 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/open-policy-agent/kube-mgmt/pkg/types"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/restmapper"
+)
+
+// expandWildcard returns the resource types matched by a wildcard, with
+// their scope as discovered. A lone wildcard matches every resource, in the
+// preferred version of each group. <group>/* matches every resource of the
+// group, in its preferred version, <version>/* every resource of the core
+// group version, e.g. v1/*, and <group>/<version>/* every resource of the
+// group version. Wildcards are expanded once, on startup.
+//
+// Only resources that can be listed and watched are returned. Resource
+// types are sorted with the core group first, so that core resources win
+// over resources of the same name in other groups, e.g. events.
+func expandWildcard(client discovery.DiscoveryInterface, gvk groupVersionKind) ([]types.ResourceType, error) {
+	var gvs []schema.GroupVersion
+	switch {
+	case gvk.Group != "":
+		gvs = append(gvs, schema.GroupVersion{Group: gvk.Group, Version: gvk.Version})
+	default:
+		groups, err := client.ServerGroups()
+		if err != nil {
+			return nil, fmt.Errorf("failed to discover API groups: %w", err)
+		}
+		for _, group := range groups.Groups {
+			if gvk.Version == "" || group.Name == gvk.Version {
+				gvs = append(gvs, schema.GroupVersion{Group: group.Name, Version: group.PreferredVersion.Version})
+			}
+		}
+		if gvk.Version != "" && len(gvs) == 0 {
+			// Not a group, so a version of the core group
+			gvs = append(gvs, schema.GroupVersion{Version: gvk.Version})
+		}
+	}
+	sort.Slice(gvs, func(i, j int) bool {
+		if (gvs[i].Group == "") != (gvs[j].Group == "") {
+			return gvs[i].Group == ""
+		}
+		return gvs[i].Group < gvs[j].Group
+	})
+
+	var result []types.ResourceType
+	for _, gv := range gvs {
+		list, err := client.ServerResourcesForGroupVersion(gv.String())
+		if err != nil {
+			if gvk.Version == "" {
+				// Skip groups that are unavailable, e.g. an aggregated API
+				// whose backend is down, when replicating everything.
+				logrus.Warnf("Failed to discover resources of %v: %v", gv, err)
+				continue
+			}
+			return nil, fmt.Errorf("failed to discover resources of %v: %w", gv, err)
+		}
+		for _, ar := range list.APIResources {
+			if strings.Contains(ar.Name, "/") || !canWatch(ar) { // subresources, e.g. pods/log
+				continue
+			}
+			result = append(result, types.ResourceType{
+				Namespaced: ar.Namespaced,
+				Group:      gv.Group,
+				Version:    gv.Version,
+				Resource:   ar.Name,
+			})
+		}
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("%v does not match any resource", gvk)
+	}
+	return result, nil
+}
+
+func canWatch(ar metav1.APIResource) bool {
+	verbs := map[string]struct{}{}
+	for _, verb := range ar.Verbs {
+		verbs[verb] = struct{}{}
+	}
+	_, list := verbs["list"]
+	_, watch := verbs["watch"]
+	return list && watch
+}
+
+// versionPattern matches Kubernetes API versions, e.g. v1 or v2beta1
+var versionPattern = regexp.MustCompile(`^v[0-9]+((alpha|beta)[0-9]+)?$`)
+
+// maxSuggestions is the number of names suggested for unknown resources
+const maxSuggestions = 5
+
+// resourceResolver resolves resources given by Kind or by resource name,
+// singular, plural or short, e.g. Deployment, deployments or deploy, to
+// their resource types in the given or preferred version.
+type resourceResolver struct {
+	mapper meta.RESTMapper
+	names  []string // all names resources are known by, for suggestions
+}
+
+func newResourceResolver(client discovery.DiscoveryInterface) (*resourceResolver, error) {
+	groupResources, err := restmapper.GetAPIGroupResources(client)
+	if discovery.IsGroupDiscoveryFailedError(err) {
+		logrus.Warnf("Failed to discover some resources: %v", err)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to discover resources: %w", err)
+	}
+	warn := func(msg string) { logrus.Warn(msg) }
+	r := &resourceResolver{
+		mapper: restmapper.NewShortcutExpander(restmapper.NewDiscoveryRESTMapper(groupResources), client, warn),
+	}
+	seen := map[string]struct{}{}
+	for _, group := range groupResources {
+		for _, resources := range group.VersionedResources {
+			for _, ar := range resources {
+				if strings.Contains(ar.Name, "/") { // subresources, e.g. pods/log
+					continue
+				}
+				for _, name := range append([]string{ar.Name, ar.SingularName, strings.ToLower(ar.Kind)}, ar.ShortNames...) {
+					if _, ok := seen[name]; !ok && name != "" {
+						seen[name] = struct{}{}
+						r.names = append(r.names, name)
+					}
+				}
+			}
+		}
+	}
+	sort.Strings(r.names)
+	return r, nil
+}
+
+// resolve returns the type of the resource, with its scope as discovered.
+// Without a group, a version such as v1 is told apart from a group such as
+// apps by its format.
+func (r *resourceResolver) resolve(gvk groupVersionKind) (types.ResourceType, error) {
+	input := schema.GroupVersionResource{Group: gvk.Group, Version: gvk.Version, Resource: strings.ToLower(gvk.Kind)}
+	if input.Group == "" && input.Version != "" && !versionPattern.MatchString(input.Version) {
+		input.Group, input.Version = input.Version, ""
+	}
+	gvr, err := r.mapper.ResourceFor(input)
+	if err == nil && input.Version != "" && gvr.Version != input.Version {
+		// Short names expand to the preferred version, resolve the
+		// expanded name in the version asked for instead.
+		gvr, err = r.mapper.ResourceFor(gvr.GroupResource().WithVersion(input.Version))
+	}
+	if err != nil {
+		return types.ResourceType{}, r.notFound(gvk, err)
+	}
+	kind, err := r.mapper.KindFor(gvr)
+	if err != nil {
+		return types.ResourceType{}, r.notFound(gvk, err)
+	}
+	mapping, err := r.mapper.RESTMapping(kind.GroupKind(), kind.Version)
+	if err != nil {
+		return types.ResourceType{}, r.notFound(gvk, err)
+	}
+	return types.ResourceType{
+		Namespaced: mapping.Scope.Name() == meta.RESTScopeNameNamespace,
+		Group:      gvr.Group,
+		Version:    gvr.Version,
+		Resource:   gvr.Resource,
+	}, nil
+}
+
+// notFound returns the error for an unknown resource, suggesting the
+// names closest to the one given.
+func (r *resourceResolver) notFound(gvk groupVersionKind, err error) error {
+	name := strings.ToLower(gvk.Kind)
+	type suggestion struct {
+		name     string
+		distance int
+	}
+	var suggestions []suggestion
+	for _, candidate := range r.names {
+		distance := levenshtein(name, candidate)
+		if distance <= len(name)/3+1 || strings.Contains(candidate, name) {
+			suggestions = append(suggestions, suggestion{candidate, distance})
+		}
+	}
+	if len(suggestions) == 0 {
+		return fmt.Errorf("resource %v not found: %w", gvk, err)
+	}
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		return suggestions[i].distance < suggestions[j].distance
+	})
+	names := make([]string, 0, maxSuggestions)
+	for i := 0; i < len(suggestions) && i < maxSuggestions; i++ {
+		names = append(names, suggestions[i].name)
+	}
+	return fmt.Errorf("resource %v not found, did you mean: %v?", gvk, strings.Join(names, ", "))
+}
+
+// levenshtein returns the edit distance between a and b
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr := make([]int, len(b)+1)
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev = curr
+	}
+	return prev[len(b)]
+}
@@ -16,16 +16,27 @@ type groupVersionKind struct {
 	Kind    string
 }
 
-var errBadFormat = errors.New("format: group/version/kind")
+var errBadFormat = errors.New("format: [group/][version/]resource")
 
 func (gvk groupVersionKind) String() string {
 	if gvk.Group != "" {
 		return fmt.Sprintf("%v/%v/%v", gvk.Group, gvk.Version, gvk.Kind)
 	}
+	if gvk.Version == "" {
+		return gvk.Kind
+	}
 	return fmt.Sprintf("%v/%v", gvk.Version, gvk.Kind)
 }
 
+// wildcard is the resource matching all resources of a group or version,
+// e.g. networking.k8s.io/*, or of the cluster when given alone.
+const wildcard = "*"
+
 func (gvk *groupVersionKind) Parse(value string) error {
+	if value == wildcard {
+		*gvk = groupVersionKind{Kind: wildcard}
+		return nil
+	}
 	parts := strings.SplitN(value, "/", 3)
 	for i := range parts {
 		if len(parts[i]) == 0 {
@@ -33,13 +44,13 @@ func (gvk *groupVersionKind) Parse(value string) error {
 		}
 		parts[i] = strings.ToLower(parts[i])
 	}
-	if len(parts) < 2 {
-		return errBadFormat
-	}
-	if len(parts) == 2 {
+	switch len(parts) {
+	case 1:
+		gvk.Kind = parts[0]
+	case 2:
 		gvk.Version = parts[0]
 		gvk.Kind = parts[1]
-	} else {
+	default:
 		gvk.Group = parts[0]
 		gvk.Version = parts[1]
 		gvk.Kind = parts[2]
@@ -63,5 +74,5 @@ func (f *gvkFlag) Set(value string) error {
 }
 
 func (f *gvkFlag) Type() string {
-	return "[group/]version/resource"
+	return "[group/][version/]resource|group/*|[group/]version/*|*"
 }
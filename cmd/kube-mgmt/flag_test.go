@@ -14,7 +14,7 @@ func TestFlagParsing(t *testing.T) {
 
 	badPaths := []string{
 		"foo/bar/",
-		"foo",
+		"/foo",
 	}
 
 	for _, tc := range badPaths {
@@ -43,6 +43,12 @@ func TestFlagParsing(t *testing.T) {
 		t.Fatalf("Expected %v but got: %v (err: %v)", expected, f, err)
 	}
 
+	expected = append(expected, groupVersionKind{"", "", "deployment"})
+
+	if err := f.Set("Deployment"); err != nil || !reflect.DeepEqual(expected, f) {
+		t.Fatalf("Expected %v but got: %v (err: %v)", expected, f, err)
+	}
+
 }
 
 func TestFlagString(t *testing.T) {
@@ -11,8 +11,12 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	"strings"
+	gosync "sync"
+	"syscall"
+	"time"
 
 	"github.com/open-policy-agent/kube-mgmt/pkg/configmap"
 	"github.com/open-policy-agent/kube-mgmt/pkg/data"
@@ -26,34 +30,42 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
-	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
 type params struct {
-	version            bool
-	kubeconfigFile     string
-	opaURL             string
-	opaAuth            string
-	opaAuthFile        string
-	opaCAFile          string
-	opaAllowInsecure   bool
-	policyLabel        string
-	policyValue        string
-	dataLabel          string
-	dataValue          string
-	enablePolicies     bool
-	enableData         bool
-	namespaces         []string
-	opaConfigFile      string
-	replicateCluster   gvkFlag
-	replicateNamespace gvkFlag
-	replicatePath      string
-	logLevel           string
-	replicateIgnoreNs  []string
-	analysisEntrypoint string
-	healthEndpoint     string
+	version             bool
+	kubeconfigFile      string
+	opaURL              string
+	opaAuth             string
+	opaAuthFile         string
+	opaCAFile           string
+	opaAllowInsecure    bool
+	policyLabel         string
+	policyValue         string
+	dataLabel           string
+	dataValue           string
+	enablePolicies      bool
+	enableData          bool
+	namespaces          []string
+	opaConfigFile       string
+	analysisPolicyDir   string
+	analysisLinger      time.Duration
+	replicateCluster    gvkFlag
+	replicateNamespace  gvkFlag
+	replicateResource   gvkFlag
+	replicatePath       string
+	replicateConfigFile string
+	replicateFlush      time.Duration
+	replicateCleanup    bool
+	remoteKubeconfigDir string
+	remoteKubeconfigNs  string
+	logLevel            string
+	replicateIgnoreNs   []string
+	analysisEntrypoints []string
+	healthEndpoint      string
 }
 
 func main() {
@@ -99,11 +111,19 @@ func main() {
 	// replication
 	rootCmd.Flags().VarP(&params.replicateNamespace, "replicate", "", "replicate namespace-level resources")
 	rootCmd.Flags().VarP(&params.replicateCluster, "replicate-cluster", "", "replicate cluster-level resources")
+	rootCmd.Flags().VarP(&params.replicateResource, "replicate-resource", "", "replicate resources, at the scope discovered for each")
 	rootCmd.Flags().StringVarP(&params.replicatePath, "replicate-path", "", "kubernetes", "set path to replicate data into")
+	rootCmd.Flags().StringVarP(&params.replicateConfigFile, "replicate-config", "", "", "set file containing resources to replicate and their replication options")
+	rootCmd.Flags().DurationVarP(&params.replicateFlush, "replicate-flush-interval", "", 0, "set interval to batch replicated changes over before writing them into OPA (disabled by default)")
+	rootCmd.Flags().BoolVarP(&params.replicateCleanup, "replicate-cleanup", "", false, "remove replicated data from OPA once policies no longer refer to it, and data of resources no longer replicated on startup")
+	rootCmd.Flags().StringVarP(&params.remoteKubeconfigDir, "remote-kubeconfig-dir", "", "", "set directory of kubeconfig files of remote clusters to replicate from, each into <replicate-path>/<file name>")
+	rootCmd.Flags().StringVarP(&params.remoteKubeconfigNs, "remote-kubeconfig-namespace", "", "", "set namespace of Cluster API kubeconfig secrets of remote clusters to replicate from, each into <replicate-path>/<cluster name>")
 	rootCmd.Flags().StringSliceVarP(&params.replicateIgnoreNs, "replicate-ignore-namespaces", "", []string{""}, "namespaces that are ignored by replication")
 	rootCmd.Flags().StringVarP(&params.opaConfigFile, "opa-config", "", "", "set file containing OPA configuration to enable data replication based on configured bundles")
-	rootCmd.Flags().StringVarP(&params.analysisEntrypoint, "analysis-entrypoint", "", "main/main", "set decision to analyze for dynamic data replication configuration (requires --opa-config)")
-	rootCmd.Flags().StringVarP(&params.healthEndpoint, "health-endpoint", "", "", "set health check listening endpoint (e.g., localhost:8000)")
+	rootCmd.Flags().StringVarP(&params.analysisPolicyDir, "analysis-policy-dir", "", "", "set directory of .rego files to analyze for dynamic data replication, watched for changes")
+	rootCmd.Flags().StringSliceVarP(&params.analysisEntrypoints, "analysis-entrypoint", "", []string{"main/main"}, "set decision to analyze for dynamic data replication configuration, may be specified multiple times (requires --opa-config or --analysis-policy-dir)")
+	rootCmd.Flags().DurationVarP(&params.analysisLinger, "analysis-linger", "", 0, "set how long resources keep being replicated once policies no longer refer to them (stops right away by default)")
+	rootCmd.Flags().StringVarP(&params.healthEndpoint, "health-endpoint", "", "", "set health check listening endpoint (e.g., localhost:8000), also serving /debug/replication for dynamic data replication, /debug/replication/static for the other replicated resources and /health/clusters/<name> for remote clusters")
 
 	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
 		if rootCmd.Flag("policy-label").Value.String() != "" || rootCmd.Flag("policy-value").Value.String() != "" {
@@ -183,10 +203,41 @@ func run(params *params) {
 		http.DefaultTransport.(*http.Transport).TLSClientConfig = config
 	}
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Options shared by static and dynamic replication
+	replicateOpts := append([]data.Option{data.WithInformers(data.NewInformers())}, replicateOptions(params)...)
+
+	var sync *dynamicdata.Sync
+
+	if params.opaConfigFile != "" || params.analysisPolicyDir != "" {
+		logger := logging.New()
+		switch params.logLevel {
+		case "debug":
+			logger.SetLevel(logging.Debug)
+		case "info":
+			logger.SetLevel(logging.Info)
+		case "error":
+			logger.SetLevel(logging.Error)
+		}
+		sync, err = dynamicdata.New(params.opaConfigFile, params.analysisPolicyDir, params.analysisEntrypoints, params.opaURL, params.opaAuth, params.replicateIgnoreNs, params.replicatePath, kubeconfig, logger, replicateOpts...)
+		if err != nil {
+			logrus.Fatalf("Failed to create dynamic synchronizer: %v", err)
+		}
+		sync.SetLinger(params.analysisLinger)
+		sync.SetRemoveData(params.replicateCleanup)
+	}
+
 	if params.enablePolicies || params.enableData {
-		sync := configmap.New(
+		var client opa.Client = opa.New(params.opaURL, params.opaAuth)
+		if sync != nil {
+			// Analyze policies from ConfigMaps for dynamic data replication
+			client = sync.Policies(client)
+		}
+		cmSync := configmap.New(
 			kubeconfig,
-			opa.New(params.opaURL, params.opaAuth),
+			client,
 			configmap.DefaultConfigMapMatcher(
 				params.namespaces,
 				params.enablePolicies,
@@ -197,51 +248,83 @@ func run(params *params) {
 				params.dataValue,
 			),
 		)
-		_, err = sync.Run(params.namespaces)
+		_, err = cmSync.Run(params.namespaces)
 		if err != nil {
 			logrus.Fatalf("Failed to start configmap sync: %v", err)
 		}
 	}
 
-	if len(params.replicateCluster)+len(params.replicateNamespace) > 0 {
-		client, err := dynamic.NewForConfig(kubeconfig)
-		if err != nil {
-			logrus.Fatalf("Failed to get dynamic client: %v", err)
-		}
+	clientset, err := kubernetes.NewForConfig(kubeconfig)
+	if err != nil {
+		logrus.Fatalf("Failed to get kubernetes client: %v", err)
+	}
 
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
+	replications, err := getReplications(params, clientset, clientset.Discovery())
+	if err != nil {
+		logrus.Fatalf("Invalid replication configuration: %v", err)
+	}
 
-		opts := data.WithIgnoreNamespaces(params.replicateIgnoreNs)
+	clusters, err := loadRemoteClusters(params, clientset, replications)
+	if err != nil {
+		logrus.Fatalf("Failed to load remote clusters: %v", err)
+	}
 
-		for _, gvk := range params.replicateCluster {
-			sync := data.NewFromInterface(client, opa.New(params.opaURL, params.opaAuth).Prefix(params.replicatePath), getResourceType(gvk, false), opts)
-			go sync.RunContext(ctx)
+	if params.replicateCleanup {
+		rts := make([]types.ResourceType, 0, len(replications))
+		for _, r := range replications {
+			rts = append(rts, r.resourceType)
+		}
+		names := make([]string, 0, len(clusters))
+		for _, c := range clusters {
+			names = append(names, c.name)
 		}
+		target := opa.New(params.opaURL, params.opaAuth).Prefix(params.replicatePath)
+		if sync != nil {
+			// Wait for the resources replicated dynamically to be known
+			sync.SetCleanup(func(ctx context.Context, keep []string) {
+				removeStaleData(ctx, target, rts, append(names, keep...)...)
+			})
+		} else {
+			removeStaleData(ctx, target, rts, names...)
+		}
+	}
 
-		for _, gvk := range params.replicateNamespace {
-			sync := data.NewFromInterface(client, opa.New(params.opaURL, params.opaAuth).Prefix(params.replicatePath), getResourceType(gvk, true), opts)
-			go sync.RunContext(ctx)
+	var replicating gosync.WaitGroup
+	status := &staticStatus{clusters: clusters}
+	if len(replications) > 0 {
+		opts := append([]data.Option{data.WithIgnoreNamespaces(params.replicateIgnoreNs)}, replicateOpts...)
+		target := opa.New(params.opaURL, params.opaAuth).Prefix(params.replicatePath)
+		status.local, err = startReplications(ctx, &replicating, kubeconfig, target, replications, opts)
+		if err != nil {
+			logrus.Fatalf("Failed to start replication: %v", err)
 		}
 	}
 
-	var sync *dynamicdata.Sync
+	for _, c := range clusters {
+		replicating.Add(1)
+		go func() {
+			defer replicating.Done()
+			c.run(ctx, params, clientset)
+		}()
+	}
 
-	if params.opaConfigFile != "" {
-		logger := logging.New()
-		switch params.logLevel {
-		case "debug":
-			logger.SetLevel(logging.Debug)
-		case "info":
-			logger.SetLevel(logging.Info)
-		case "error":
-			logger.SetLevel(logging.Error)
+	if sync != nil {
+		// Resources replicated statically are not replicated dynamically
+		static := make([]string, 0, len(replications))
+		for _, r := range replications {
+			static = append(static, r.resourceType.Resource)
 		}
-		sync, err = dynamicdata.New(params.opaConfigFile, params.analysisEntrypoint, params.opaURL, params.opaAuth, params.replicateIgnoreNs, params.replicatePath, kubeconfig, logger)
-		if err != nil {
-			logrus.Fatalf("Failed to create dynamic synchronizer: %v", err)
+		sync.SetStatic(static)
+		names := make([]string, 0, len(clusters))
+		for _, c := range clusters {
+			names = append(names, c.name)
 		}
-		go sync.Run(context.Background())
+		sync.SetClusters(names)
+		go func() {
+			if err := sync.Run(ctx); err != nil {
+				logrus.Errorf("Failed to start dynamic synchronizer: %v", err)
+			}
+		}()
 	}
 
 	if params.healthEndpoint != "" {
@@ -256,6 +339,21 @@ func run(params *params) {
 					w.WriteHeader(http.StatusInternalServerError)
 				}
 			})
+			if sync != nil {
+				mux.Handle("/debug/replication", sync)
+			}
+			mux.Handle("/debug/replication/static", status)
+			for _, c := range clusters {
+				mux.HandleFunc("/health/clusters/"+c.name, func(w http.ResponseWriter, r *http.Request) {
+					if c.Ready() {
+						logrus.Debugf("health check of cluster %v: READY", c.name)
+						w.WriteHeader(http.StatusOK)
+					} else {
+						logrus.Debugf("health check of cluster %v: NOT READY", c.name)
+						w.WriteHeader(http.StatusInternalServerError)
+					}
+				})
+			}
 			server := &http.Server{
 				Addr:    params.healthEndpoint,
 				Handler: mux,
@@ -268,8 +366,36 @@ func run(params *params) {
 		}()
 	}
 
-	quit := make(chan struct{})
-	<-quit
+	<-ctx.Done()
+	logrus.Info("Shutting down")
+	if sync != nil {
+		sync.Wait()
+	}
+	replicating.Wait()
+}
+
+// removeStaleData removes the data of resources no longer replicated, while
+// OPA may still be starting up.
+func removeStaleData(ctx context.Context, client opa.Data, rts []types.ResourceType, keep ...string) {
+	const attempts = 5
+	delay := time.Second
+	for i := 1; ; i++ {
+		err := data.RemoveStale(client, rts, keep...)
+		if err == nil {
+			return
+		}
+		if i == attempts {
+			logrus.Errorf("Failed to remove stale replicated data: %v", err)
+			return
+		}
+		logrus.Warnf("Failed to remove stale replicated data (will retry after %v): %v", delay, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
 }
 
 func loadRESTConfig(path string) (*rest.Config, error) {
@@ -278,12 +404,3 @@ func loadRESTConfig(path string) (*rest.Config, error) {
 	}
 	return rest.InClusterConfig()
 }
-
-func getResourceType(gvk groupVersionKind, namespaced bool) types.ResourceType {
-	return types.ResourceType{
-		Namespaced: namespaced,
-		Group:      gvk.Group,
-		Version:    gvk.Version,
-		Resource:   gvk.Kind,
-	}
-}
@@ -0,0 +1,372 @@
+// Copyright 2017 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/open-policy-agent/kube-mgmt/pkg/data"
+	"github.com/open-policy-agent/kube-mgmt/pkg/opa"
+	"github.com/open-policy-agent/kube-mgmt/pkg/transform"
+	"github.com/open-policy-agent/kube-mgmt/pkg/types"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/yaml"
+)
+
+// replicateConfig is the format of the file given with --replicate-config.
+type replicateConfig struct {
+	Resources []replicateResource `json:"resources"`
+}
+
+// replicateResource configures the replication of a single resource type.
+type replicateResource struct {
+	// Resource is the resource to replicate, as [group/][version/]resource.
+	// The resource is either its Kind or its plural, singular or short name.
+	Resource string `json:"resource"`
+	// Cluster is set for cluster-level resources. The scope discovered
+	// prevails, with a warning, when it differs.
+	Cluster bool `json:"cluster,omitempty"`
+	// LabelSelector and FieldSelector restrict the objects that are
+	// replicated, e.g. `type=kubernetes.io/tls` for Secrets.
+	LabelSelector string `json:"labelSelector,omitempty"`
+	FieldSelector string `json:"fieldSelector,omitempty"`
+	// Namespaces restricts replication to the listed namespaces, and
+	// NamespaceSelector to namespaces whose labels match the selector.
+	Namespaces        []string `json:"namespaces,omitempty"`
+	NamespaceSelector string   `json:"namespaceSelector,omitempty"`
+	// MetadataOnly only replicates the metadata of each object.
+	MetadataOnly bool `json:"metadataOnly,omitempty"`
+	// Include and Exclude select the fields of each object that are
+	// replicated. When neither is set, metadata.managedFields is dropped.
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+	// Transform runs each object through a Rego function before it is
+	// replicated.
+	Transform *transformConfig `json:"transform,omitempty"`
+	// Key is a template for the path of each object, e.g. {{.metadata.uid}}
+	Key string `json:"key,omitempty"`
+	// Indexes maintained next to the replicated objects.
+	Indexes []indexConfig `json:"indexes,omitempty"`
+}
+
+// indexConfig maps the values at a field path to the objects holding them.
+type indexConfig struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// transformConfig locates a Rego function and the policies defining it.
+// The policies are loaded either from a file or from all the keys of a
+// ConfigMap.
+type transformConfig struct {
+	// Function is the reference to the function, e.g. data.transforms.pod
+	Function string `json:"function"`
+	// File containing the policy.
+	File string `json:"file,omitempty"`
+	// ConfigMap containing the policies, as namespace/name.
+	ConfigMap string `json:"configMap,omitempty"`
+}
+
+// replication is a resource type to replicate, and the options to
+// replicate it with.
+type replication struct {
+	resourceType types.ResourceType
+	opts         []data.Option
+	metadataOnly bool
+}
+
+func loadReplicateConfig(path string) (*replicateConfig, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config replicateConfig
+	if err := yaml.UnmarshalStrict(bs, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse %v: %w", path, err)
+	}
+	return &config, nil
+}
+
+func (r replicateResource) replication(client kubernetes.Interface, resolver *resolver) (replication, error) {
+	var gvk groupVersionKind
+	if err := gvk.Parse(r.Resource); err != nil {
+		return replication{}, fmt.Errorf("resource %q: %w", r.Resource, err)
+	}
+	if gvk.Kind == wildcard {
+		return replication{}, fmt.Errorf("resource %q: wildcards are only supported by the --replicate flags", r.Resource)
+	}
+	rt, err := resolver.resolveIn(gvk, !r.Cluster)
+	if err != nil {
+		return replication{}, err
+	}
+	result := replication{resourceType: rt, metadataOnly: r.MetadataOnly}
+	if r.LabelSelector != "" {
+		if _, err := labels.Parse(r.LabelSelector); err != nil {
+			return replication{}, fmt.Errorf("resource %q: invalid label selector: %w", r.Resource, err)
+		}
+		result.opts = append(result.opts, data.WithLabelSelector(r.LabelSelector))
+	}
+	if r.FieldSelector != "" {
+		if _, err := fields.ParseSelector(r.FieldSelector); err != nil {
+			return replication{}, fmt.Errorf("resource %q: invalid field selector: %w", r.Resource, err)
+		}
+		result.opts = append(result.opts, data.WithFieldSelector(r.FieldSelector))
+	}
+	if !rt.Namespaced && (len(r.Namespaces) > 0 || r.NamespaceSelector != "") {
+		return replication{}, fmt.Errorf("resource %q: namespaces cannot be selected for cluster-level resources", r.Resource)
+	}
+	if len(r.Namespaces) > 0 {
+		result.opts = append(result.opts, data.WithNamespaces(r.Namespaces))
+	}
+	if r.NamespaceSelector != "" {
+		if _, err := labels.Parse(r.NamespaceSelector); err != nil {
+			return replication{}, fmt.Errorf("resource %q: invalid namespace selector: %w", r.Resource, err)
+		}
+		result.opts = append(result.opts, data.WithNamespaceSelector(r.NamespaceSelector))
+	}
+	if len(r.Include) > 0 || len(r.Exclude) > 0 {
+		projection, err := data.NewProjection(r.Include, r.Exclude)
+		if err != nil {
+			return replication{}, fmt.Errorf("resource %q: %w", r.Resource, err)
+		}
+		result.opts = append(result.opts, data.WithProjection(projection))
+	}
+	if r.Transform != nil {
+		transformer, err := r.Transform.load(client)
+		if err != nil {
+			return replication{}, fmt.Errorf("resource %q: %w", r.Resource, err)
+		}
+		result.opts = append(result.opts, data.WithTransform(transformer))
+	}
+	if r.Key != "" {
+		keyTemplate, err := data.NewKeyTemplate(r.Key)
+		if err != nil {
+			return replication{}, fmt.Errorf("resource %q: invalid key: %w", r.Resource, err)
+		}
+		result.opts = append(result.opts, data.WithKeyTemplate(keyTemplate))
+	}
+	if len(r.Indexes) > 0 && r.Key != "" {
+		return replication{}, fmt.Errorf("resource %q: indexes cannot be used with a key", r.Resource)
+	}
+	if len(r.Indexes) > 0 {
+		indexes := make([]*data.Index, 0, len(r.Indexes))
+		for _, i := range r.Indexes {
+			index, err := data.NewIndex(i.Name, i.Path)
+			if err != nil {
+				return replication{}, fmt.Errorf("resource %q: invalid index: %w", r.Resource, err)
+			}
+			indexes = append(indexes, index)
+		}
+		result.opts = append(result.opts, data.WithIndexes(indexes...))
+	}
+	return result, nil
+}
+
+func (t *transformConfig) load(client kubernetes.Interface) (*transform.Rego, error) {
+	ctx := context.Background()
+	modules := map[string]string{}
+	switch {
+	case t.File != "" && t.ConfigMap != "":
+		return nil, fmt.Errorf("transform must not set both file and configMap")
+	case t.File != "":
+		bs, err := os.ReadFile(t.File)
+		if err != nil {
+			return nil, err
+		}
+		modules[filepath.Base(t.File)] = string(bs)
+	case t.ConfigMap != "":
+		namespace, name, ok := strings.Cut(t.ConfigMap, "/")
+		if !ok || namespace == "" || name == "" {
+			return nil, fmt.Errorf("transform configMap %q must be namespace/name", t.ConfigMap)
+		}
+		cm, err := client.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get transform configMap: %w", err)
+		}
+		for key, value := range cm.Data {
+			modules[fmt.Sprintf("%v/%v", t.ConfigMap, key)] = value
+		}
+	default:
+		return nil, fmt.Errorf("transform must set either file or configMap")
+	}
+	return transform.NewRego(ctx, t.Function, modules)
+}
+
+// resolver resolves the resources to replicate through discovery, which
+// only happens once the first resource needs it.
+type resolver struct {
+	client   discovery.DiscoveryInterface
+	resolver *resourceResolver
+}
+
+// resolve returns the type of the resource, with its scope as discovered.
+func (r *resolver) resolve(gvk groupVersionKind) (types.ResourceType, error) {
+	if r.resolver == nil {
+		resolver, err := newResourceResolver(r.client)
+		if err != nil {
+			return types.ResourceType{}, err
+		}
+		r.resolver = resolver
+	}
+	return r.resolver.resolve(gvk)
+}
+
+// resolveIn returns the type of the resource, given at the scope it is
+// expected at. Resources are replicated at the scope discovered, as watches
+// ignoring namespaces fail for cluster-level resources.
+func (r *resolver) resolveIn(gvk groupVersionKind, namespaced bool) (types.ResourceType, error) {
+	rt, err := r.resolve(gvk)
+	if err != nil {
+		return types.ResourceType{}, err
+	}
+	if rt.Namespaced != namespaced {
+		logrus.Warnf("Replicating %v as %v, not %v as given", rt, scopeName(rt.Namespaced), scopeName(namespaced))
+	}
+	return rt, nil
+}
+
+func scopeName(namespaced bool) string {
+	if namespaced {
+		return "namespace-level"
+	}
+	return "cluster-level"
+}
+
+// getReplications combines the resources given with --replicate,
+// --replicate-cluster and --replicate-resource with those in the
+// --replicate-config file. Resources are resolved through discovery, and
+// wildcards are expanded last, skipping the resources replicated already.
+// Resources are discovered through dc, the client of the cluster they are
+// replicated from, while transforms are loaded through client.
+func getReplications(params *params, client kubernetes.Interface, dc discovery.DiscoveryInterface) ([]replication, error) {
+	var result []replication
+	var wildcards []groupVersionKind
+	resolver := &resolver{client: dc}
+	for _, gvk := range params.replicateCluster {
+		if gvk.Kind == wildcard {
+			wildcards = append(wildcards, gvk)
+			continue
+		}
+		rt, err := resolver.resolveIn(gvk, false)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, replication{resourceType: rt})
+	}
+	for _, gvk := range params.replicateNamespace {
+		if gvk.Kind == wildcard {
+			wildcards = append(wildcards, gvk)
+			continue
+		}
+		rt, err := resolver.resolveIn(gvk, true)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, replication{resourceType: rt})
+	}
+	for _, gvk := range params.replicateResource {
+		if gvk.Kind == wildcard {
+			wildcards = append(wildcards, gvk)
+			continue
+		}
+		rt, err := resolver.resolve(gvk)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, replication{resourceType: rt})
+	}
+
+	if params.replicateConfigFile != "" {
+		config, err := loadReplicateConfig(params.replicateConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range config.Resources {
+			rep, err := r.replication(client, resolver)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, rep)
+		}
+	}
+
+	seen := map[string]struct{}{}
+	for _, r := range result {
+		if _, ok := seen[r.resourceType.Resource]; ok {
+			return nil, fmt.Errorf("resource %v is replicated more than once", r.resourceType)
+		}
+		seen[r.resourceType.Resource] = struct{}{}
+	}
+
+	for _, gvk := range wildcards {
+		rts, err := expandWildcard(dc, gvk)
+		if err != nil {
+			return nil, err
+		}
+		for _, rt := range rts {
+			if _, ok := seen[rt.Resource]; ok {
+				logrus.Infof("Skipping %v matched by %v, %v is replicated already", rt, gvk, rt.Resource)
+				continue
+			}
+			seen[rt.Resource] = struct{}{}
+			result = append(result, replication{resourceType: rt})
+		}
+	}
+	return result, nil
+}
+
+// replicateOptions returns the options shared by the replications of all
+// clusters, static or dynamic. Informers are left out as they cannot be
+// shared across clusters.
+func replicateOptions(params *params) []data.Option {
+	var opts []data.Option
+	if params.replicateFlush > 0 {
+		opts = append(opts, data.WithBatching(params.replicateFlush))
+	}
+	return opts
+}
+
+// startReplications starts a GenericSync for each replication, until the
+// context is done.
+func startReplications(ctx context.Context, wg *sync.WaitGroup, kubeconfig *rest.Config, target opa.Data, replications []replication, opts []data.Option) ([]*data.GenericSync, error) {
+	client, err := dynamic.NewForConfig(kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get dynamic client: %w", err)
+	}
+	metadataClient, err := metadata.NewForConfig(kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get metadata client: %w", err)
+	}
+
+	syncs := make([]*data.GenericSync, 0, len(replications))
+	for _, r := range replications {
+		rOpts := append(append([]data.Option{}, opts...), r.opts...)
+		if r.metadataOnly {
+			rOpts = append(rOpts, data.WithMetadataOnly(metadataClient))
+		}
+		sync := data.NewFromInterface(client, target, r.resourceType, rOpts...)
+		syncs = append(syncs, sync)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sync.RunContext(ctx)
+		}()
+	}
+	return syncs, nil
+}
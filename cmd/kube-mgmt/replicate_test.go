@@ -0,0 +1,370 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/kube-mgmt/pkg/types"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func writeReplicateConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "replicate.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+var watchable = metav1.Verbs{"get", "list", "watch"}
+
+// apiResource is a watchable resource, named by its kind.
+func apiResource(name, kind string, namespaced bool, shortNames ...string) metav1.APIResource {
+	return metav1.APIResource{
+		Name:         name,
+		SingularName: strings.ToLower(kind),
+		Kind:         kind,
+		Namespaced:   namespaced,
+		ShortNames:   shortNames,
+		Verbs:        watchable,
+	}
+}
+
+// withResources makes the resources discoverable through the client.
+func withResources(client *fake.Clientset, resources ...*metav1.APIResourceList) *fake.Clientset {
+	client.Discovery().(*fakediscovery.FakeDiscovery).Resources = resources
+	return client
+}
+
+// coreResources are the resources discovered by most tests.
+var coreResources = []*metav1.APIResourceList{
+	{
+		GroupVersion: "v1",
+		APIResources: []metav1.APIResource{
+			apiResource("pods", "Pod", true, "po"),
+			apiResource("secrets", "Secret", true),
+			apiResource("nodes", "Node", false, "no"),
+		},
+	},
+	{
+		GroupVersion: "apps/v1",
+		APIResources: []metav1.APIResource{
+			apiResource("deployments", "Deployment", true, "deploy"),
+		},
+	},
+}
+
+func TestGetReplications(t *testing.T) {
+	path := writeReplicateConfig(t, `
+resources:
+- resource: v1/secrets
+  fieldSelector: type=kubernetes.io/tls
+  labelSelector: app in (web, api)
+  key: "{{.metadata.uid}}"
+- resource: v1/pods
+  namespaces: [default, web]
+  namespaceSelector: opa-replicate=true
+  exclude:
+  - metadata.managedFields
+  - status
+  indexes:
+  - name: serviceAccount
+    path: spec.serviceAccountName
+- resource: v1/nodes
+  cluster: true
+  metadataOnly: true
+  transform:
+    function: data.transforms.node
+    configMap: opa/transforms
+`)
+	client := withResources(fake.NewSimpleClientset(&apiv1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "opa", Name: "transforms"},
+		Data: map[string]string{
+			"node.rego": "package transforms\nnode(obj) := obj.metadata.name",
+		},
+	}), coreResources...)
+
+	params := &params{replicateConfigFile: path}
+	if err := params.replicateNamespace.Set("apps/v1/deployments"); err != nil {
+		t.Fatal(err)
+	}
+
+	replications, err := getReplications(params, client, client.Discovery())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var got []types.ResourceType
+	for _, r := range replications {
+		got = append(got, r.resourceType)
+	}
+	expected := []types.ResourceType{
+		{Namespaced: true, Group: "apps", Version: "v1", Resource: "deployments"},
+		{Namespaced: true, Version: "v1", Resource: "secrets"},
+		{Namespaced: true, Version: "v1", Resource: "pods"},
+		{Namespaced: false, Version: "v1", Resource: "nodes"},
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Fatalf("Expected %v but got: %v", expected, got)
+	}
+	optCount := []int{0, 3, 4, 1}
+	for i, r := range replications {
+		if len(r.opts) != optCount[i] {
+			t.Fatalf("Expected %d options for %v but got %d", optCount[i], r.resourceType, len(r.opts))
+		}
+	}
+	if !replications[3].metadataOnly {
+		t.Fatalf("Expected nodes to replicate metadata only")
+	}
+}
+
+func TestGetReplicationsErrors(t *testing.T) {
+	configs := map[string]string{
+		"duplicate":     "resources: [{resource: v1/pods}, {resource: v1/pods}]",
+		"bad resource":  "resources: [{resource: /pods}]",
+		"unknown":       "resources: [{resource: v1/podz}]",
+		"bad path":      "resources: [{resource: v1/pods, include: [spec..containers]}]",
+		"unknown field": "resources: [{resource: v1/pods, namespaced: true}]",
+		"bad labels":    "resources: [{resource: v1/pods, labelSelector: 'a in b'}]",
+		"bad fields":    "resources: [{resource: v1/pods, fieldSelector: 'a'}]",
+		"cluster ns":    "resources: [{resource: v1/nodes, cluster: true, namespaces: [default]}]",
+		"bad ns labels": "resources: [{resource: v1/pods, namespaceSelector: '!'}]",
+		"no transform":  "resources: [{resource: v1/pods, transform: {function: data.x.f}}]",
+		"bad key":       "resources: [{resource: v1/pods, key: '{{.metadata.uid'}]",
+		"bad index":     "resources: [{resource: v1/pods, indexes: [{name: a/b, path: spec.nodeName}]}]",
+		"key indexes":   "resources: [{resource: v1/pods, key: '{{.metadata.uid}}', indexes: [{name: node, path: spec.nodeName}]}]",
+		"wildcard":      "resources: [{resource: networking.k8s.io/*}]",
+		"missing cm":    "resources: [{resource: v1/pods, transform: {function: data.x.f, configMap: opa/missing}}]",
+	}
+	for name, config := range configs {
+		t.Run(name, func(t *testing.T) {
+			params := &params{replicateConfigFile: writeReplicateConfig(t, config)}
+			client := withResources(fake.NewSimpleClientset(), coreResources...)
+			if _, err := getReplications(params, client, client.Discovery()); err == nil {
+				t.Fatalf("Expected error")
+			}
+		})
+	}
+}
+
+func TestGetReplicationsWildcards(t *testing.T) {
+	client := withResources(fake.NewSimpleClientset(),
+		&metav1.APIResourceList{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{
+				apiResource("pods", "Pod", true),
+				{Name: "pods/log", Namespaced: true, Verbs: metav1.Verbs{"get"}},
+				{Name: "bindings", Kind: "Binding", Namespaced: true, Verbs: metav1.Verbs{"create"}},
+				apiResource("events", "Event", true),
+				apiResource("nodes", "Node", false),
+			},
+		},
+		&metav1.APIResourceList{
+			GroupVersion: "events.k8s.io/v1",
+			APIResources: []metav1.APIResource{
+				apiResource("events", "Event", true),
+			},
+		},
+		&metav1.APIResourceList{
+			GroupVersion: "networking.k8s.io/v1",
+			APIResources: []metav1.APIResource{
+				apiResource("ingresses", "Ingress", true),
+				apiResource("ingressclasses", "IngressClass", false),
+			},
+		},
+	)
+
+	pods := types.ResourceType{Namespaced: true, Version: "v1", Resource: "pods"}
+	events := types.ResourceType{Namespaced: true, Version: "v1", Resource: "events"}
+	nodes := types.ResourceType{Namespaced: false, Version: "v1", Resource: "nodes"}
+	eventsV1 := types.ResourceType{Namespaced: true, Group: "events.k8s.io", Version: "v1", Resource: "events"}
+	ingresses := types.ResourceType{Namespaced: true, Group: "networking.k8s.io", Version: "v1", Resource: "ingresses"}
+	ingressClasses := types.ResourceType{Namespaced: false, Group: "networking.k8s.io", Version: "v1", Resource: "ingressclasses"}
+
+	tests := []struct {
+		name      string
+		replicate []string
+		cluster   []string
+		expected  []types.ResourceType
+		err       bool
+	}{
+		{
+			name:      "group",
+			replicate: []string{"networking.k8s.io/*"},
+			expected:  []types.ResourceType{ingresses, ingressClasses},
+		},
+		{
+			name:     "group version",
+			cluster:  []string{"networking.k8s.io/v1/*"},
+			expected: []types.ResourceType{ingresses, ingressClasses},
+		},
+		{
+			name:      "core version",
+			replicate: []string{"v1/*"},
+			expected:  []types.ResourceType{pods, events, nodes},
+		},
+		{
+			name:      "everything",
+			replicate: []string{"*"},
+			expected:  []types.ResourceType{pods, events, nodes, ingresses, ingressClasses},
+		},
+		{
+			name:      "explicit first",
+			replicate: []string{"*", "events.k8s.io/v1/events"},
+			expected:  []types.ResourceType{eventsV1, pods, nodes, ingresses, ingressClasses},
+		},
+		{
+			name:      "unknown group version",
+			replicate: []string{"example.com/v1/*"},
+			err:       true,
+		},
+		{
+			name:      "unknown version",
+			replicate: []string{"v2/*"},
+			err:       true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			params := &params{}
+			for _, value := range tc.replicate {
+				if err := params.replicateNamespace.Set(value); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, value := range tc.cluster {
+				if err := params.replicateCluster.Set(value); err != nil {
+					t.Fatal(err)
+				}
+			}
+			replications, err := getReplications(params, client, client.Discovery())
+			if tc.err {
+				if err == nil {
+					t.Fatalf("Expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			var got []types.ResourceType
+			for _, r := range replications {
+				got = append(got, r.resourceType)
+			}
+			if !reflect.DeepEqual(tc.expected, got) {
+				t.Fatalf("Expected %v but got: %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestGetReplicationsResolve(t *testing.T) {
+	client := withResources(fake.NewSimpleClientset(), append(coreResources,
+		&metav1.APIResourceList{
+			GroupVersion: "apps/v1beta2",
+			APIResources: []metav1.APIResource{
+				apiResource("deployments", "Deployment", true, "deploy"),
+			},
+		},
+	)...)
+
+	pods := types.ResourceType{Namespaced: true, Version: "v1", Resource: "pods"}
+	deployments := types.ResourceType{Namespaced: true, Group: "apps", Version: "v1", Resource: "deployments"}
+	nodes := types.ResourceType{Namespaced: false, Version: "v1", Resource: "nodes"}
+
+	tests := []struct {
+		name      string
+		replicate string
+		cluster   string
+		expected  types.ResourceType
+		err       string
+	}{
+		{name: "resource", replicate: "apps/v1/deployments", expected: deployments},
+		{name: "kind", replicate: "Deployment", expected: deployments},
+		{name: "singular", replicate: "pod", expected: pods},
+		{name: "short name", replicate: "deploy", expected: deployments},
+		{name: "short name cluster", cluster: "no", expected: nodes},
+		{name: "group", replicate: "apps/Deployment", expected: deployments},
+		{name: "version", replicate: "v1/po", expected: pods},
+		{
+			name:      "other version",
+			replicate: "apps/v1beta2/deploy",
+			expected:  types.ResourceType{Namespaced: true, Group: "apps", Version: "v1beta2", Resource: "deployments"},
+		},
+		{name: "unknown", replicate: "deploymnts", err: "did you mean: deployments"},
+		{name: "unknown version", replicate: "apps/v2/deployments", err: "not found"},
+		{name: "unknown group", replicate: "example.com/Pod", err: "not found"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			params := &params{}
+			if tc.replicate != "" {
+				if err := params.replicateNamespace.Set(tc.replicate); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tc.cluster != "" {
+				if err := params.replicateCluster.Set(tc.cluster); err != nil {
+					t.Fatal(err)
+				}
+			}
+			replications, err := getReplications(params, client, client.Discovery())
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("Expected error containing %q but got: %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(replications) != 1 || replications[0].resourceType != tc.expected {
+				t.Fatalf("Expected %v but got: %v", tc.expected, replications)
+			}
+		})
+	}
+}
+
+func TestGetReplicationsScope(t *testing.T) {
+	client := withResources(fake.NewSimpleClientset(), coreResources...)
+
+	params := &params{}
+	for _, value := range []string{"pods", "v1/nodes", "Deployment"} {
+		if err := params.replicateResource.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The scope given with --replicate-cluster is corrected by discovery
+	if err := params.replicateCluster.Set("v1/secrets"); err != nil {
+		t.Fatal(err)
+	}
+
+	replications, err := getReplications(params, client, client.Discovery())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var got []types.ResourceType
+	for _, r := range replications {
+		got = append(got, r.resourceType)
+	}
+	expected := []types.ResourceType{
+		{Namespaced: true, Version: "v1", Resource: "secrets"},
+		{Namespaced: true, Version: "v1", Resource: "pods"},
+		{Namespaced: false, Version: "v1", Resource: "nodes"},
+		{Namespaced: true, Group: "apps", Version: "v1", Resource: "deployments"},
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Fatalf("Expected %v but got: %v", expected, got)
+	}
+}
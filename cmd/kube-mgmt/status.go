@@ -0,0 +1,58 @@
+// Copyright 2017 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/open-policy-agent/kube-mgmt/pkg/data"
+
+	"github.com/sirupsen/logrus"
+)
+
+// resourceStatus is the state of the replication of a resource given with
+// the --replicate flags or the --replicate-config file.
+type resourceStatus struct {
+	Cluster         string `json:"cluster,omitempty"` // remote clusters only
+	ResourceType    string `json:"resource_type"`
+	Ready           bool   `json:"ready"`
+	TransformErrors int64  `json:"transform_errors,omitempty"`
+}
+
+// staticStatus reports the state of the replications of the local cluster
+// and of the remote clusters as JSON.
+type staticStatus struct {
+	local    []*data.GenericSync
+	clusters []*remoteCluster
+}
+
+func (s *staticStatus) resources() []resourceStatus {
+	result := []resourceStatus{}
+	add := func(cluster string, syncs []*data.GenericSync) {
+		for _, sync := range syncs {
+			result = append(result, resourceStatus{
+				Cluster:         cluster,
+				ResourceType:    sync.ResourceType().String(),
+				Ready:           sync.Ready(),
+				TransformErrors: sync.TransformErrors(),
+			})
+		}
+	}
+	add("", s.local)
+	for _, c := range s.clusters {
+		add(c.name, c.replications())
+	}
+	return result
+}
+
+func (s *staticStatus) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(s.resources()); err != nil {
+		logrus.Errorf("Failed to write replication status: %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/kube-mgmt/pkg/data"
+	"github.com/open-policy-agent/kube-mgmt/pkg/opa"
+	"github.com/open-policy-agent/kube-mgmt/pkg/types"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestStaticStatus(t *testing.T) {
+
+	client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	pods := types.ResourceType{Namespaced: true, Version: "v1", Resource: "pods"}
+	nodes := types.ResourceType{Version: "v1", Resource: "nodes"}
+
+	cluster := &remoteCluster{name: "prod"}
+	cluster.syncs = []*data.GenericSync{data.NewFromInterface(client, opa.New("http://localhost", ""), nodes)}
+	status := &staticStatus{
+		local:    []*data.GenericSync{data.NewFromInterface(client, opa.New("http://localhost", ""), pods)},
+		clusters: []*remoteCluster{cluster, {name: "staging"}},
+	}
+
+	rec := httptest.NewRecorder()
+	status.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/replication/static", nil))
+
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("Expected JSON but got: %v", ct)
+	}
+	var result []resourceStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	expected := []resourceStatus{
+		{ResourceType: pods.String()},
+		{Cluster: "prod", ResourceType: nodes.String()},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatalf("Expected %v but got: %v", expected, result)
+	}
+}
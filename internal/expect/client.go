@@ -10,8 +10,9 @@ import (
 // Client emulates OPA Client API
 type Client struct {
 	PrefixList []string
-	// This function will be called on every request
-	actor func(req Request, value interface{}) error
+	// This function will be called on every request, and returns the
+	// Request expected by the script
+	actor func(req Request, value interface{}) (Request, error)
 }
 
 // Prefix implements Data
@@ -31,7 +32,17 @@ func (f *Client) PatchData(path string, op string, value *interface{}) (err erro
 	if value != nil {
 		actualValue = *value
 	}
-	return f.actor(req, actualValue)
+	_, err = f.actor(req, actualValue)
+	return err
+}
+
+// PatchDataOps implements OpsPatcher
+func (f *Client) PatchDataOps(ops []opa_client.PatchOp) (err error) {
+	req := Request{
+		req: patchOpsRequest,
+	}
+	_, err = f.actor(req, ops)
+	return err
 }
 
 // PutData implements Data
@@ -40,23 +51,35 @@ func (f *Client) PutData(path string, value interface{}) (err error) {
 		req:  putRequest,
 		path: path,
 	}
-	return f.actor(req, value)
+	_, err = f.actor(req, value)
+	return err
 }
 
-var errNotSupported = errors.New("PostData not supported")
+var errNotSupported = errors.New("not supported")
 
 // PostData implements Data. Currently not supported.
 func (*Client) PostData(string, interface{}) (json.RawMessage, error) {
 	return nil, errNotSupported
 }
 
+// ListData implements DataLister, returning the keys listed by the script
+func (f *Client) ListData(path string) ([]string, error) {
+	req := Request{
+		req:  listRequest,
+		path: path,
+	}
+	cue, err := f.actor(req, nil)
+	return cue.keys, err
+}
+
 // InsertPolicy implements Policies
 func (f *Client) InsertPolicy(path string, value []byte) (err error) {
 	req := Request{
 		req:  insertPolicyRequest,
 		path: path,
 	}
-	return f.actor(req, value)
+	_, err = f.actor(req, value)
+	return err
 }
 
 // DeletePolicy implements Policies
@@ -65,5 +88,6 @@ func (f *Client) DeletePolicy(path string) (err error) {
 		req:  deletePolicyRequest,
 		path: path,
 	}
-	return f.actor(req, nil)
+	_, err = f.actor(req, nil)
+	return err
 }
@@ -10,7 +10,9 @@ type request string
 
 const (
 	patchRequest        request = "PatchData"
+	patchOpsRequest     request = "PatchDataOps"
 	putRequest          request = "PutData"
+	listRequest         request = "ListData"
 	insertPolicyRequest request = "InsertPolicy"
 	deletePolicyRequest request = "DeletePolicy"
 	noRequest           request = "Nothing"
@@ -23,6 +25,7 @@ type Request struct {
 	op       string
 	value    []byte
 	interval time.Duration // Only applies to script.Expect(Nothing())
+	keys     []string      // Only applies to script.Expect(ListData())
 }
 
 // Equals compares two requests
@@ -38,6 +41,9 @@ func (r Request) String() string {
 	if r.value != nil {
 		return fmt.Sprintf("{req: %q, path: %q, op: %q, value: %q}", r.req, r.path, r.op, string(r.value))
 	}
+	if r.keys != nil {
+		return fmt.Sprintf("{req: %q, path: %q, keys: %q}", r.req, r.path, r.keys)
+	}
 	return fmt.Sprintf("{req: %q, path: %q, op: %q}", r.req, r.path, r.op)
 }
 
@@ -69,6 +75,24 @@ func PatchData(path string, op string, expected ...[]byte) Request {
 	}
 }
 
+// PatchDataOps describes a PatchDataOps request with an optional expected
+// list of operations (expected value can be omitted)
+func PatchDataOps(expected ...[]byte) Request {
+	return Request{
+		req:   patchOpsRequest,
+		value: optional(expected...),
+	}
+}
+
+// ListData describes a ListData request, listing the given keys
+func ListData(path string, keys ...string) Request {
+	return Request{
+		req:  listRequest,
+		path: path,
+		keys: keys,
+	}
+}
+
 // InsertPolicy describes a InsertPolicy request with an optional expected value
 // (expected value can be omitted)
 func InsertPolicy(path string, expected ...[]byte) Request {
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -43,13 +44,17 @@ func Play(t *testing.T, script Script, show func(ctx context.Context, client *Cl
 	}
 
 	var (
-		actor     func(req Request, value interface{}) error
+		actor     func(req Request, value interface{}) (Request, error)
 		improvise func(cursor int)
 		cursor    int = 0
 	)
+	// Requests may come from several goroutines
+	var mu sync.Mutex
 
-	actor = func(req Request, value interface{}) error {
+	actor = func(req Request, value interface{}) (Request, error) {
+		mu.Lock()
 		if cursor >= len(script) {
+			mu.Unlock()
 			t.Fatalf("Expected at most %d steps, got one more request %v", len(script), req)
 		}
 		// Save the actual value received to req. We do it
@@ -64,6 +69,7 @@ func Play(t *testing.T, script Script, show func(ctx context.Context, client *Cl
 		cue := script[cursor]
 		if !cue.Equals(req) {
 			seq := script[:cursor+1].strings("\n\t")
+			mu.Unlock()
 			t.Fatalf("Expected sequence:\n\t%v\nError at step %d, got:\n\t%v", seq, cursor, req)
 		}
 		cursor++
@@ -71,10 +77,11 @@ func Play(t *testing.T, script Script, show func(ctx context.Context, client *Cl
 			// If the next update is timed, schedule it.
 			go improvise(cursor)
 		}
+		mu.Unlock()
 		if cue.Action == nil {
-			return nil
+			return cue.Request, nil
 		}
-		return cue.Action()
+		return cue.Request, cue.Action()
 	}
 
 	// improvise triggers the step without any external input
@@ -0,0 +1,24 @@
+// Copyright 2017 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+// Package policy parses the Rego policies evaluated or analyzed inside
+// kube-mgmt.
+package policy
+
+import (
+	//lint:ignore SA1019 using OPA v0.x to ensure backwards compatible with pre-1.0 bundles
+	"github.com/open-policy-agent/opa/ast"
+)
+
+// ParseModule parses the module as OPA 1.0 would, falling back to the
+// syntax of earlier versions.
+func ParseModule(name, src string) (*ast.Module, error) {
+	module, err := ast.ParseModuleWithOpts(name, src, ast.ParserOptions{RegoVersion: ast.RegoV1})
+	if err != nil {
+		if module, errV0 := ast.ParseModuleWithOpts(name, src, ast.ParserOptions{RegoVersion: ast.RegoV0}); errV0 == nil {
+			return module, nil
+		}
+	}
+	return module, err
+}
@@ -0,0 +1,145 @@
+// Copyright 2017 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package data
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	opa_client "github.com/open-policy-agent/kube-mgmt/pkg/opa"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// maxBatchSize is the maximum number of keys written in a single patch.
+const maxBatchSize = 500
+
+// replicatedKeys tracks the objects written into OPA, and the namespaces
+// holding them. JSON Patch operations fail when adding an object under a
+// missing namespace, or when removing a missing object, so batches are
+// built against this record of what OPA contains.
+type replicatedKeys struct {
+	keys map[string]struct{}
+	dirs map[string]struct{}
+}
+
+func newReplicatedKeys() *replicatedKeys {
+	return &replicatedKeys{
+		keys: map[string]struct{}{},
+		dirs: map[string]struct{}{},
+	}
+}
+
+func (r *replicatedKeys) add(key string) {
+	r.keys[key] = struct{}{}
+	if dir, _, ok := strings.Cut(key, "/"); ok {
+		r.dirs[dir] = struct{}{}
+	}
+}
+
+// remove forgets the object. Its namespace is kept, since OPA keeps the
+// (possibly empty) namespace document.
+func (r *replicatedKeys) remove(key string) {
+	delete(r.keys, key)
+}
+
+func (r *replicatedKeys) has(key string) bool {
+	_, ok := r.keys[key]
+	return ok
+}
+
+func (r *replicatedKeys) hasDir(dir string) bool {
+	_, ok := r.dirs[dir]
+	return ok
+}
+
+// collect waits for the flush interval, then returns the first key along
+// with the keys queued meanwhile. The keys are not marked as done, so the
+// queue holds back new events for them until the batch has been written.
+// It returns nil right away if the context is done while waiting.
+func (s *GenericSync) collect(ctx context.Context, queue workqueue.TypedDelayingInterface[any], first interface{}) []interface{} {
+	timer := time.NewTimer(s.flushInterval)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return nil
+	}
+	keys := []interface{}{first}
+	for n := queue.Len(); n > 0 && len(keys) < maxBatchSize; n-- {
+		key, shuttingDown := queue.Get()
+		if shuttingDown {
+			break
+		}
+		if key == initPath { // everything is loaded already
+			queue.Done(key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// processBatch writes the current state of the objects for all keys with
+// a single JSON Patch. Each key appears once in a batch, so the patch holds
+// one operation per object.
+func (s *GenericSync) processBatch(store objectStore, keys []interface{}) error {
+
+	var ops []opa_client.PatchOp
+	changes := make(map[string]bool, len(keys)) // replicated or not, once written
+	dirs := map[string]struct{}{}               // namespaces added by this batch
+
+	for _, k := range keys {
+		key := k.(string)
+		obj, exists, err := store.GetByKey(key)
+		if err != nil {
+			return fmt.Errorf("store error: %w", err)
+		}
+		var value interface{}
+		if exists {
+			value, exists = s.prepare(key, obj)
+			s.setDropped(key, !exists)
+		} else {
+			s.setDropped(key, false)
+		}
+		if !exists {
+			if s.replicated.has(key) {
+				ops = append(ops, opa_client.PatchOp{Op: "remove", Path: key})
+				changes[key] = false
+			}
+			continue
+		}
+		op := opa_client.PatchOp{Op: "add", Path: key, Value: &value}
+		if dir, name, ok := strings.Cut(key, "/"); ok && !s.replicated.hasDir(dir) {
+			if _, added := dirs[dir]; !added {
+				var doc interface{} = map[string]interface{}{name: value}
+				op = opa_client.PatchOp{Op: "add", Path: dir, Value: &doc}
+				dirs[dir] = struct{}{}
+			}
+		}
+		ops = append(ops, op)
+		changes[key] = true
+	}
+
+	if len(ops) == 0 {
+		return nil
+	}
+	if err := opa_client.PatchDataOps(s.opa, ops); err != nil {
+		return fmt.Errorf("batch of %d events: %w", len(ops), err)
+	}
+	logrus.Debugf("Replicated batch of %d events for %v", len(ops), s.ns)
+
+	for key, replicated := range changes {
+		if replicated {
+			s.replicated.add(key)
+		} else {
+			s.replicated.remove(key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+// Copyright 2017 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package data
+
+import (
+	opa_client "github.com/open-policy-agent/kube-mgmt/pkg/opa"
+	"github.com/open-policy-agent/kube-mgmt/pkg/types"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RemoveStale removes the documents under the replicate path that none of
+// the resource types are replicated into, e.g. those left behind in OPA by
+// a previous configuration of kube-mgmt. The documents named in other, e.g.
+// those of other clusters or of resources replicated dynamically, are kept.
+func RemoveStale(opa opa_client.Data, rts []types.ResourceType, other ...string) error {
+	keep := map[string]struct{}{IndexPath: {}}
+	for _, rt := range rts {
+		keep[rt.Resource] = struct{}{}
+	}
+	for _, name := range other {
+		keep[name] = struct{}{}
+	}
+	if err := removeStale(opa, keep); err != nil {
+		return err
+	}
+	delete(keep, IndexPath)
+	return removeStale(opa.Prefix(IndexPath), keep)
+}
+
+func removeStale(opa opa_client.Data, keep map[string]struct{}) error {
+	keys, err := opa_client.ListData(opa, "/")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if _, ok := keep[key]; ok {
+			continue
+		}
+		logrus.Infof("Removing stale replicated data %v", key)
+		if err := opa.PatchData(escapePointer(key), "remove", nil); err != nil && !opa_client.IsNotFoundErr(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package data
+
+import (
+	"context"
+	"testing"
+
+	"github.com/open-policy-agent/kube-mgmt/internal/expect"
+	"github.com/open-policy-agent/kube-mgmt/pkg/types"
+)
+
+func TestRemoveStale(t *testing.T) {
+	t.Parallel()
+
+	rts := []types.ResourceType{
+		{Namespaced: true, Resource: "pods", Version: "v1"},
+		{Namespaced: true, Group: "networking.k8s.io", Resource: "ingresses", Version: "v1"},
+	}
+	play := expect.Script{
+		expect.ListData("/", IndexPath, "ingresses", "networking.k8s.io", "pods", "prod", "services").Do(nil),
+		expect.PatchData("networking.k8s.io", "remove").Do(nil),
+		expect.PatchData("services", "remove").Do(nil),
+		expect.ListData("/", "pods", "services").Do(nil),
+		expect.PatchData("services", "remove").End(),
+	}
+
+	data := expect.Play(t, play, func(ctx context.Context, client *expect.Client) {
+		if err := RemoveStale(client, rts, "prod"); err != nil {
+			t.Fatal(err)
+		}
+	})
+	expect.MustEqual(t, data.PrefixList, []string{IndexPath})
+}
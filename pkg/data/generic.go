@@ -6,9 +6,11 @@ package data
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	opa_client "github.com/open-policy-agent/kube-mgmt/pkg/opa"
@@ -19,10 +21,13 @@ import (
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/metadata"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/workqueue"
@@ -33,20 +38,37 @@ const (
 	backoffMax   = time.Second * 30
 	backoffMin   = time.Second
 	jitterFactor = 1.2
+	maxRetries   = 5 // consecutive failed writes before reloading everything
 	FieldMeta    = "metadata.namespace!="
 )
 
 // GenericSync replicates Kubernetes resources into OPA as raw JSON.
 type GenericSync struct {
-	createError      error // to support deprecated calls to New / Run
-	client           dynamicClient
-	opa              opa_client.Data
-	ns               types.ResourceType
-	limiter          workqueue.TypedRateLimiter[any]
-	jitterFactor     float64
-	ignoreNamespaces []string
-	mu               sync.Mutex
-	ready            bool
+	createError       error // to support deprecated calls to New / Run
+	client            dynamicClient
+	opa               opa_client.Data
+	ns                types.ResourceType
+	limiter           workqueue.TypedRateLimiter[any]
+	jitterFactor      float64
+	ignoreNamespaces  []string
+	labelSelector     string
+	fieldSelector     string
+	namespaces        []string
+	namespaceSelector string
+	metadata          metadata.Interface
+	informers         *Informers
+	projection        *Projection
+	transformer       Transformer
+	transformErrors   atomic.Int64
+	flushInterval     time.Duration
+	replicated        *replicatedKeys // not tracked with a key template
+	keyTemplate       *KeyTemplate
+	keys              *templateKeys // only tracked with a key template
+	indexes           *indexes
+	indexData         opa_client.Data
+	dropped           map[string]struct{} // objects not replicated, only tracked with indexes
+	mu                sync.Mutex
+	ready             bool
 }
 
 // New returns a new GenericSync that can be started.
@@ -68,10 +90,26 @@ func NewFromInterface(client dynamic.Interface, opa opa_client.Data, ns types.Re
 		ns:           ns,
 		opa:          opa.Prefix(ns.Resource),
 		jitterFactor: jitterFactor,
+		projection:   defaultProjection,
 	}
 	for _, opt := range opts {
 		opt(s)
 	}
+	if s.keyTemplate != nil && s.flushInterval > 0 {
+		logrus.Warnf("Batching is not supported with a key template, writing %v changes one at a time", ns)
+		s.flushInterval = 0
+	}
+	if s.keyTemplate != nil && s.indexes != nil {
+		logrus.Warnf("Indexes are not supported with a key template, not indexing %v", ns)
+		s.indexes = nil
+	}
+	if s.indexes != nil {
+		s.indexData = opa.Prefix(IndexPath).Prefix(ns.Resource)
+		s.dropped = map[string]struct{}{}
+	}
+	if s.informers == nil { // Do not share informers if not configured
+		s.informers = NewInformers()
+	}
 	if s.limiter == nil { // Use default rateLimiter if not configured
 		s.limiter = workqueue.NewTypedItemExponentialFailureRateLimiter[any](backoffMin, backoffMax)
 	}
@@ -85,6 +123,105 @@ func WithIgnoreNamespaces(ignoreNamespaces []string) Option {
 	}
 }
 
+// WithLabelSelector only replicates objects matching the label selector
+func WithLabelSelector(selector string) Option {
+	return func(s *GenericSync) {
+		s.labelSelector = selector
+	}
+}
+
+// WithFieldSelector only replicates objects matching the field selector.
+// It is combined with the namespaces to ignore, if any.
+func WithFieldSelector(selector string) Option {
+	return func(s *GenericSync) {
+		s.fieldSelector = selector
+	}
+}
+
+// WithNamespaces only replicates objects from the given namespaces, running
+// a separate informer for each of them.
+func WithNamespaces(namespaces []string) Option {
+	return func(s *GenericSync) {
+		s.namespaces = namespaces
+	}
+}
+
+// WithNamespaceSelector only replicates objects from namespaces matching the
+// label selector. Objects are added or removed as namespace labels change.
+func WithNamespaceSelector(selector string) Option {
+	return func(s *GenericSync) {
+		s.namespaceSelector = selector
+	}
+}
+
+// WithMetadataOnly only watches and replicates the metadata of objects,
+// using the metadata client. Replicated objects look like
+// {"metadata": {...}}, which cuts memory use for high-cardinality
+// resources whose policies only need labels, annotations or owners.
+func WithMetadataOnly(client metadata.Interface) Option {
+	return func(s *GenericSync) {
+		s.metadata = client
+	}
+}
+
+// WithInformers shares informers with other GenericSync instances, instead
+// of running informers private to this instance.
+func WithInformers(informers *Informers) Option {
+	return func(s *GenericSync) {
+		s.informers = informers
+	}
+}
+
+// WithProjection selects the parts of each object that are replicated.
+// By default, everything but metadata.managedFields is replicated.
+func WithProjection(projection *Projection) Option {
+	return func(s *GenericSync) {
+		s.projection = projection
+	}
+}
+
+// Transformer rewrites objects before they are replicated into OPA.
+type Transformer interface {
+	// Transform returns the value to replicate in place of the object,
+	// or nil if the object must not be replicated.
+	Transform(obj interface{}) (interface{}, error)
+}
+
+// WithTransform runs every object through the Transformer before it is
+// replicated, after the projection has been applied.
+func WithTransform(transformer Transformer) Option {
+	return func(s *GenericSync) {
+		s.transformer = transformer
+	}
+}
+
+// WithKeyTemplate lays out objects in OPA by the result of the template,
+// rather than by namespace and name. When several objects share a key,
+// they are replicated as an array sorted by namespace and name.
+func WithKeyTemplate(keyTemplate *KeyTemplate) Option {
+	return func(s *GenericSync) {
+		s.keyTemplate = keyTemplate
+	}
+}
+
+// WithIndexes maintains index documents for the objects, next to them in
+// OPA under the IndexPath. Each index maps the values found in objects to
+// the namespaces and names of those objects.
+func WithIndexes(indexes ...*Index) Option {
+	return func(s *GenericSync) {
+		s.indexes = newIndexes(indexes)
+	}
+}
+
+// WithBatching collects the events queued during the flush interval, and
+// writes them into OPA with a single JSON Patch. Events for the same object
+// are coalesced, and only its latest state is written.
+func WithBatching(flushInterval time.Duration) Option {
+	return func(s *GenericSync) {
+		s.flushInterval = flushInterval
+	}
+}
+
 // WithBackoff tunes the values of exponential backoff and jitter factor
 func WithBackoff(min, max time.Duration, jitterFactor float64) Option {
 	return func(s *GenericSync) {
@@ -120,54 +257,168 @@ func (s *GenericSync) RunContext(ctx context.Context) error {
 		return s.createError
 	}
 
-	store, queue := s.setup(ctx)
+	store, queue, release, err := s.setup(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
 	go func() {
 		<-ctx.Done()
 		queue.ShutDown()
 	}()
 
-	s.loop(store, queue)
+	s.loop(ctx, store, queue)
 	return nil
 }
 
+// ResourceType returns the type of the resources replicated.
+func (s *GenericSync) ResourceType() types.ResourceType {
+	return s.ns
+}
+
+// TransformErrors returns the number of objects that failed to transform.
+func (s *GenericSync) TransformErrors() int64 {
+	return s.transformErrors.Load()
+}
+
 func (s *GenericSync) Ready() bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	return s.ready
 }
 
-// setup the store and queue for this GenericSync instance
-func (s *GenericSync) setup(ctx context.Context) (cache.Store, workqueue.TypedDelayingInterface[any]) {
-	ignoreNs := s.ignoreNs()
-
-	resource := s.client.ResourceFor(s.ns, metav1.NamespaceAll)
+// setup the store and queue for this GenericSync instance. The returned
+// function releases the informers once replication is finished.
+func (s *GenericSync) setup(ctx context.Context) (objectStore, workqueue.TypedDelayingInterface[any], func(), error) {
 	queue := workqueue.NewNamedDelayingQueue(s.ns.String())
-	store, controller := cache.NewInformerWithOptions(cache.InformerOptions{
-		ListerWatcher: &cache.ListWatch{
-			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
-				options.FieldSelector = ignoreNs
-				return resource.List(ctx, options)
-			},
-			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
-				options.FieldSelector = ignoreNs
-				return resource.Watch(ctx, options)
-			},
-		},
-		ObjectType:   &unstructured.Unstructured{},
-		Handler:      resourceEventQueue{queue},
-		ResyncPeriod: 0,
-	})
+
+	var releases []func()
+	release := func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+
+	// Run one informer per namespace when restricted to a list of them,
+	// like configmap.Sync does.
+	namespaces := []string{metav1.NamespaceAll}
+	if s.ns.Namespaced && len(s.namespaces) > 0 {
+		namespaces = s.namespaces
+	}
+
+	var synced []cache.InformerSynced
+	stores := make(namespaceStores, len(namespaces))
+	for _, namespace := range namespaces {
+		informer, registration, r, err := s.informer(namespace, resourceEventQueue{queue})
+		if err != nil {
+			release()
+			return nil, nil, nil, err
+		}
+		releases = append(releases, r)
+		stores[namespace] = informer.GetStore()
+		synced = append(synced, registration.HasSynced)
+	}
+
+	var store objectStore = stores
+	if len(stores) == 1 {
+		store = stores[namespaces[0]]
+	}
+
+	if s.ns.Namespaced && s.namespaceSelector != "" {
+		selector, err := labels.Parse(s.namespaceSelector)
+		if err != nil {
+			logrus.Errorf("Invalid namespace selector for %v, replicating nothing: %v", s.ns, err)
+			selector = labels.Nothing()
+		}
+		filter := newNamespaceFilter(selector, store, queue)
+		key := informerKey{resourceType: namespaceResource, labelSelector: s.namespaceSelector}
+		listWatch := func(ctx context.Context) cache.ListerWatcher {
+			return s.listWatch(ctx, namespaceResource, metav1.NamespaceAll, "", s.namespaceSelector)
+		}
+		_, registration, r, err := s.informers.acquire(key, listWatch, &unstructured.Unstructured{}, filter)
+		if err != nil {
+			release()
+			return nil, nil, nil, err
+		}
+		releases = append(releases, r)
+		store = filteredStore{objectStore: store, filter: filter}
+		synced = append(synced, registration.HasSynced)
+	}
 
 	start, quit := time.Now(), ctx.Done()
-	go controller.Run(quit)
-	for !cache.WaitForCacheSync(quit, controller.HasSynced) {
+	for !cache.WaitForCacheSync(quit, synced...) {
+		if ctx.Err() != nil {
+			release()
+			queue.ShutDown()
+			return nil, nil, nil, ctx.Err()
+		}
 		logrus.Warnf("Failed to sync cache for %v, retrying...", s.ns)
 	}
-	if controller.HasSynced() {
-		logrus.Infof("Initial informer sync for %v completed, took %v", s.ns, time.Since(start))
+	logrus.Infof("Initial informer sync for %v completed, took %v", s.ns, time.Since(start))
+
+	return store, queue, release, nil
+}
+
+// informer registers the handler on a shared informer for the objects of
+// this instance in a namespace
+func (s *GenericSync) informer(namespace string, handler cache.ResourceEventHandler) (cache.SharedIndexInformer, cache.ResourceEventHandlerRegistration, func(), error) {
+	key := informerKey{
+		resourceType:  s.ns,
+		namespace:     namespace,
+		fieldSelector: s.fieldSelectors(),
+		labelSelector: s.labelSelector,
+		metadataOnly:  s.metadata != nil,
+	}
+	if s.metadata != nil {
+		listWatch := func(ctx context.Context) cache.ListerWatcher {
+			return s.metadataListWatch(ctx, namespace, key.fieldSelector, key.labelSelector)
+		}
+		return s.informers.acquire(key, listWatch, &metav1.PartialObjectMetadata{}, handler)
 	}
+	listWatch := func(ctx context.Context) cache.ListerWatcher {
+		return s.listWatch(ctx, s.ns, namespace, key.fieldSelector, key.labelSelector)
+	}
+	return s.informers.acquire(key, listWatch, &unstructured.Unstructured{}, handler)
+}
 
-	return store, queue
+func (s *GenericSync) listWatch(ctx context.Context, resourceType types.ResourceType, namespace, fieldSelector, labelSelector string) cache.ListerWatcher {
+	resource := s.client.ResourceFor(resourceType, namespace)
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = fieldSelector
+			options.LabelSelector = labelSelector
+			return resource.List(ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = fieldSelector
+			options.LabelSelector = labelSelector
+			return resource.Watch(ctx, options)
+		},
+	}
+}
+
+func (s *GenericSync) metadataListWatch(ctx context.Context, namespace, fieldSelector, labelSelector string) cache.ListerWatcher {
+	getter := s.metadata.Resource(schema.GroupVersionResource{
+		Group:    s.ns.Group,
+		Version:  s.ns.Version,
+		Resource: s.ns.Resource,
+	})
+	var resource metadata.ResourceInterface = getter
+	if s.ns.Namespaced {
+		resource = getter.Namespace(namespace)
+	}
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = fieldSelector
+			options.LabelSelector = labelSelector
+			return resource.List(ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = fieldSelector
+			options.LabelSelector = labelSelector
+			return resource.Watch(ctx, options)
+		},
+	}
 }
 
 func (s *GenericSync) ignoreNs() string {
@@ -184,6 +435,19 @@ func (s *GenericSync) ignoreNs() string {
 	return ignoreNs
 }
 
+// fieldSelectors combines the configured field selector with the one
+// ignoring namespaces.
+func (s *GenericSync) fieldSelectors() string {
+	var selectors []string
+	if s.fieldSelector != "" {
+		selectors = append(selectors, s.fieldSelector)
+	}
+	if ignoreNs := s.ignoreNs(); ignoreNs != "" {
+		selectors = append(selectors, ignoreNs)
+	}
+	return strings.Join(selectors, ",")
+}
+
 // resourceEventQueue is a cache.ResourceEventHandler that queues all events
 type resourceEventQueue struct {
 	workqueue.Interface
@@ -236,9 +500,11 @@ func (q resourceEventQueue) OnDelete(obj interface{}) {
 const initPath = ""
 
 // loop starts replicating Kubernetes resources into OPA. If an error occurs
-// during the replication process, this function will backoff and reload
-// all resources into OPA from scratch.
-func (s *GenericSync) loop(store cache.Store, queue workqueue.TypedDelayingInterface[any]) {
+// while writing an object, only that object is retried with backoff. All
+// resources are reloaded into OPA from scratch when the initial load fails,
+// when writes keep failing, or when OPA may have lost the data replicated
+// so far.
+func (s *GenericSync) loop(ctx context.Context, store objectStore, queue workqueue.TypedDelayingInterface[any]) {
 
 	logrus.Infof("Syncing %v.", s.ns)
 	defer func() {
@@ -250,26 +516,61 @@ func (s *GenericSync) loop(store cache.Store, queue workqueue.TypedDelayingInter
 
 		queue.AddAfter(initPath, delay) // this special path will trigger a full load
 		syncDone := false               // discard everything until initPath
+		failures := 0                   // consecutive failures since the last success
 
 		var err error
-		for err == nil {
+		for {
 			key, shuttingDown := queue.Get()
 			if shuttingDown {
 				return
 			}
-			err = s.processNext(store, key.(string), &syncDone)
-			if key == initPath && syncDone {
-				s.limiter.Forget(initPath)
+			keys := []interface{}{key}
+			if s.flushInterval > 0 && syncDone && key != initPath {
+				if keys = s.collect(ctx, queue, key); keys == nil {
+					return
+				}
+				err = s.processBatch(store, keys)
+			} else {
+				err = s.processNext(store, queue, key.(string), &syncDone)
+			}
+			if err == nil && s.indexes != nil && syncDone && key != initPath {
+				err = s.processIndexes(store, keys)
+			}
+			for _, k := range keys {
+				queue.Done(k)
+			}
+			if err == nil {
+				for _, k := range keys {
+					s.limiter.Forget(k)
+				}
+				failures = 0
+				continue
+			}
+			failures++
+			if key == initPath || failures > maxRetries || needsReload(err) {
+				break
+			}
+			for _, k := range keys {
+				retry := wait.Jitter(s.limiter.When(k), s.jitterFactor)
+				logrus.Warnf("Sync for %v of %v failed, trying again in %v. Reason: %v", k, s.ns, retry, err)
+				queue.AddAfter(k, retry)
 			}
-			queue.Done(key)
 		}
 
-		delay := wait.Jitter(s.limiter.When(initPath), s.jitterFactor)
-		logrus.Errorf("Sync for %v failed, trying again in %v. Reason: %v", s.ns, delay, err)
+		delay = wait.Jitter(s.limiter.When(initPath), s.jitterFactor)
+		logrus.Errorf("Sync for %v failed, reloading in %v. Reason: %v", s.ns, delay, err)
 	}
 }
 
-func (s *GenericSync) processNext(store cache.Store, path string, syncDone *bool) error {
+// needsReload returns true if OPA may have lost the data replicated so far:
+// it could not be reached, so it may have restarted, or a document that was
+// replicated is not found.
+func needsReload(err error) bool {
+	var opaErr *opa_client.Error
+	return !errors.As(err, &opaErr) || opa_client.IsNotFoundErr(err)
+}
+
+func (s *GenericSync) processNext(store objectStore, queue workqueue.Interface, path string, syncDone *bool) error {
 
 	// On receiving the initPath, load a full dump of the data store
 	if path == initPath {
@@ -280,6 +581,11 @@ func (s *GenericSync) processNext(store cache.Store, path string, syncDone *bool
 		if err := s.syncAll(list); err != nil {
 			return err
 		}
+		if s.indexes != nil {
+			if err := s.syncIndexes(list); err != nil {
+				return err
+			}
+		}
 		s.mu.Lock()
 		s.ready = true
 		s.mu.Unlock()
@@ -293,58 +599,120 @@ func (s *GenericSync) processNext(store cache.Store, path string, syncDone *bool
 		return nil
 	}
 
+	if s.keyTemplate != nil {
+		return s.processTemplateKey(store, queue, path)
+	}
+
 	obj, exists, err := store.GetByKey(path)
 	if err != nil {
 		return fmt.Errorf("store error: %w", err)
 	}
-	if exists {
-		if err := s.opa.PutData(path, obj); err != nil {
-			return fmt.Errorf("add event: %w", err)
-		}
-	} else {
-		if err := s.opa.PatchData(path, "remove", nil); err != nil {
-			return fmt.Errorf("delete event: %w", err)
-		}
+	if !exists {
+		s.setDropped(path, false)
+		return s.remove(path, "delete event")
+	}
+	value, ok := s.prepare(path, obj)
+	s.setDropped(path, !ok)
+	if !ok {
+		return s.remove(path, "drop event")
+	}
+	if err := s.opa.PutData(path, value); err != nil {
+		return fmt.Errorf("add event: %w", err)
+	}
+	s.replicated.add(path)
+	return nil
+}
+
+// remove removes the object from OPA, unless it was never replicated, e.g.
+// because it is in a namespace not selected, or was dropped by the transform.
+func (s *GenericSync) remove(path, event string) error {
+	if !s.replicated.has(path) {
+		return nil
+	}
+	if err := s.opa.PatchData(path, "remove", nil); err != nil && !opa_client.IsNotFoundErr(err) {
+		return fmt.Errorf("%v: %w", event, err)
 	}
+	s.replicated.remove(path)
 	return nil
 }
 
 func (s *GenericSync) syncAll(objs []interface{}) error {
 
-	// Build a list of patches to apply.
-	payload, err := generateSyncPayload(objs, s.ns.Namespaced)
+	if s.keyTemplate != nil {
+		return s.syncAllTemplate(objs)
+	}
+
+	// Record the objects replicated, that events and batches are built upon,
+	// and the objects dropped, that indexes leave out.
+	replicated, dropped := newReplicatedKeys(), map[string]struct{}{}
+	prepare := func(key string, obj interface{}) (interface{}, bool) {
+		value, ok := s.prepare(key, obj)
+		if ok {
+			replicated.add(key)
+		} else {
+			dropped[key] = struct{}{}
+		}
+		return value, ok
+	}
+
+	// Build the payload, streamed from the store when sent to OPA.
+	payload, err := generateSyncPayload(objs, s.ns.Namespaced, prepare)
 	if err != nil {
 		return err
 	}
 
-	return s.opa.PutData("/", payload)
+	if err := s.opa.PutData("/", payload); err != nil {
+		return err
+	}
+	s.replicated = replicated
+	if s.indexes != nil {
+		s.dropped = dropped
+	}
+	return nil
 }
 
-func generateSyncPayload(objs []interface{}, namespaced bool) (map[string]interface{}, error) {
-	combined := make(map[string]interface{}, len(objs))
-	for _, obj := range objs {
-		path, err := cache.MetaNamespaceKeyFunc(obj)
-		if err != nil {
-			return nil, err
-		}
+// syncAllTemplate loads all objects, laid out by the key template.
+func (s *GenericSync) syncAllTemplate(objs []interface{}) error {
+	keys, groups, err := templateGroups(s.keyTemplate, objs)
+	if err != nil {
+		return err
+	}
+	entries := make([]payloadEntry, 0, len(groups))
+	for key, g := range groups {
+		entries = append(entries, payloadEntry{key: key, path: strings.Split(key, "/"), obj: g})
+	}
+	if err := s.opa.PutData("/", newSyncPayload(entries, s.prepareGroup)); err != nil {
+		return err
+	}
+	s.keys = keys
+	return nil
+}
 
-		// Ensure the path in the map up to our value exists
-		// We make some assumptions about the paths that do exist
-		// being the correct types due to the expected uniform
-		// paths for each of the similar object types being
-		// sync'd with the GenericSync instance.
-		segments := strings.Split(path, "/")
-		dir := combined
-		for i := 0; i < len(segments)-1; i++ {
-			next, ok := combined[segments[i]]
-			if !ok {
-				next = map[string]interface{}{}
-				dir[segments[i]] = next
-			}
-			dir = next.(map[string]interface{})
-		}
-		dir[segments[len(segments)-1]] = obj
+// prepare returns the value replicated into OPA for an object, or false if
+// the object must not be replicated.
+func (s *GenericSync) prepare(key string, obj interface{}) (interface{}, bool) {
+	if m, ok := obj.(*metav1.PartialObjectMetadata); ok {
+		obj = metadataObject(m)
 	}
+	value := s.projection.Apply(obj)
+	if s.transformer == nil {
+		return value, true
+	}
+	value, err := s.transformer.Transform(value)
+	if err != nil {
+		count := s.transformErrors.Add(1)
+		logrus.Errorf("Failed to transform %v %v, not replicating it (%d transform errors so far): %v", s.ns, key, count, err)
+		return nil, false
+	}
+	return value, value != nil
+}
 
-	return combined, nil
+// metadataObject returns the document replicated for the metadata of an
+// object, leaving out the PartialObjectMetadata type information.
+func metadataObject(m *metav1.PartialObjectMetadata) interface{} {
+	u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&m.ObjectMeta)
+	if err != nil {
+		return m
+	}
+	return map[string]interface{}{"metadata": u}
 }
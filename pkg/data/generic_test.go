@@ -4,10 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/open-policy-agent/kube-mgmt/internal/expect"
+	opa_client "github.com/open-policy-agent/kube-mgmt/pkg/opa"
 	"github.com/open-policy-agent/kube-mgmt/pkg/types"
 
 	apiv1 "k8s.io/api/core/v1"
@@ -17,6 +19,8 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/dynamic/fake"
 	"k8s.io/client-go/kubernetes/scheme"
+	metadatafake "k8s.io/client-go/metadata/fake"
+	clienttesting "k8s.io/client-go/testing"
 )
 
 type testCase struct {
@@ -527,6 +531,16 @@ func TestGenericSync(t *testing.T) {
 			t.Parallel()
 			tc.testRetryDelete(t)
 		})
+
+		t.Run(fmt.Sprintf("%s - Must Reload When OPA Is Unreachable", tc.Label), func(t *testing.T) {
+			t.Parallel()
+			tc.testReloadUnreachable(t)
+		})
+
+		t.Run(fmt.Sprintf("%s - Must Reload After Repeated Errors", tc.Label), func(t *testing.T) {
+			t.Parallel()
+			tc.testReloadRepeatedErrors(t)
+		})
 	}
 }
 
@@ -607,7 +621,7 @@ func (tc *testCase) testGenerateSyncPayload(t *testing.T, expected []byte) {
 		data = append(data, obj)
 	}
 
-	patches, err := generateSyncPayload(data, tc.ResourceType.Namespaced)
+	patches, err := generateSyncPayload(data, tc.ResourceType.Namespaced, (&GenericSync{projection: defaultProjection}).prepare)
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -690,13 +704,16 @@ func (tc *testCase) testRetryLoad(t *testing.T, expected []byte) {
 	tc.Play(t, client, play)
 }
 
+// errInternal is returned by OPA when a write fails on its side
+var errInternal = &opa_client.Error{Code: "internal_error", Message: "test failure"}
+
 func (tc *testCase) testRetryAdd(t *testing.T) {
 
 	client, obj := newFakeDynamicClient(t), tc.Objs[0]
 	play := expect.Script{
 		expect.PutData("/").Do(client.MustCreate(t, tc.ResourceType, obj)),
-		expect.PutData(expect.MustKey(t, obj)).DoError(errors.New("test fail update")),
-		expect.PutData("/").End(),
+		expect.PutData(expect.MustKey(t, obj)).DoError(errInternal),
+		expect.PutData(expect.MustKey(t, obj), expect.MustRoundTrip(t, obj)).End(),
 	}
 
 	tc.Play(t, client, play)
@@ -711,10 +728,8 @@ func (tc *testCase) testRetryUpdate(t *testing.T) {
 	client := newFakeDynamicClient(t, tc.Objs...)
 	play := expect.Script{
 		expect.PutData("/").Do(client.MustUpdate(t, tc.ResourceType, change)),
-		expect.PutData(expect.MustKey(t, change)).DoError(errors.New("Failed to update")),
-		expect.PutData("/").End(),
-		// don't check the payload on this last put, because we
-		// have removed an item so it no longer matches the tc.expected
+		expect.PutData(expect.MustKey(t, change)).DoError(errInternal),
+		expect.PutData(expect.MustKey(t, change), expect.MustRoundTrip(t, change.Object)).End(),
 	}
 
 	tc.Play(t, client, play)
@@ -725,15 +740,39 @@ func (tc *testCase) testRetryDelete(t *testing.T) {
 	client, obj := newFakeDynamicClient(t, tc.Objs...), tc.Objs[0]
 	play := expect.Script{
 		expect.PutData("/").Do(client.MustRemove(t, tc.ResourceType, obj)),
-		expect.PatchData(expect.MustKey(t, obj), "remove").DoError(errors.New("test Patch failed")),
+		expect.PatchData(expect.MustKey(t, obj), "remove").DoError(errInternal),
+		expect.PatchData(expect.MustKey(t, obj), "remove").End(),
+	}
+
+	tc.Play(t, client, play)
+}
+
+func (tc *testCase) testReloadUnreachable(t *testing.T) {
+
+	client, obj := newFakeDynamicClient(t), tc.Objs[0]
+	play := expect.Script{
+		expect.PutData("/").Do(client.MustCreate(t, tc.ResourceType, obj)),
+		expect.PutData(expect.MustKey(t, obj)).DoError(errors.New("connection refused")),
 		expect.PutData("/").End(),
-		// don't check the payload on this last put, because we
-		// have removed an item so it no longer matches the tc.expected
 	}
 
 	tc.Play(t, client, play)
 }
 
+func (tc *testCase) testReloadRepeatedErrors(t *testing.T) {
+
+	client, obj := newFakeDynamicClient(t), tc.Objs[0]
+	play := expect.Script{
+		expect.PutData("/").Do(client.MustCreate(t, tc.ResourceType, obj)),
+	}
+	for i := 0; i <= maxRetries; i++ {
+		play = append(play, expect.PutData(expect.MustKey(t, obj)).DoError(errInternal))
+	}
+	play = append(play, expect.PutData("/").End())
+
+	tc.Play(t, client, play)
+}
+
 func (tc *testCase) testUpdateSameVersion(t *testing.T) {
 
 	change := mustUnstructure(t, tc.Objs[0])
@@ -873,3 +912,512 @@ func TestGenericSync_ignoreNs(t *testing.T) {
 		})
 	}
 }
+
+// transformFunc adapts a function to the Transformer interface
+type transformFunc func(obj interface{}) (interface{}, error)
+
+func (f transformFunc) Transform(obj interface{}) (interface{}, error) {
+	return f(obj)
+}
+
+func TestGenericSyncTransform(t *testing.T) {
+	t.Parallel()
+
+	resourceType := types.ResourceType{Namespaced: true, Resource: "pods", Version: "v1"}
+	transform := transformFunc(func(obj interface{}) (interface{}, error) {
+		name := obj.(map[string]interface{})["metadata"].(map[string]interface{})["name"]
+		switch name {
+		case "bad":
+			return nil, errors.New("test transform failed")
+		case "dropped":
+			return nil, nil
+		}
+		return map[string]interface{}{"name": name}, nil
+	})
+
+	client := newFakeDynamicClient(t, testPod("pod1", "ns1"), testPod("bad", "ns1"), testPod("dropped", "ns1"))
+	expected := expect.MustRoundTrip(t, expect.MustUnmarshal(t, []byte(`{"ns1": {"pod1": {"name": "pod1"}}}`)))
+	play := expect.Script{
+		expect.PutData("/", expected).End(),
+	}
+
+	var sync *GenericSync
+	expect.Play(t, play, func(ctx context.Context, mockClient *expect.Client) {
+		sync = NewFromInterface(client, mockClient, resourceType, WithTransform(transform))
+		sync.RunContext(ctx)
+	})
+
+	if errs := sync.TransformErrors(); errs != 1 {
+		t.Fatalf("Expected 1 transform error but got: %d", errs)
+	}
+}
+
+func TestGenericSyncLabelSelector(t *testing.T) {
+	t.Parallel()
+
+	resourceType := types.ResourceType{Namespaced: true, Resource: "pods", Version: "v1"}
+	pod1 := testPodWith("pod1", "ns1", func(p *apiv1.Pod) { p.Labels = map[string]string{"app": "web"} })
+	pod2 := testPodWith("pod2", "ns1", func(p *apiv1.Pod) { p.Labels = map[string]string{"app": "db"} })
+
+	client := newFakeDynamicClient(t, pod1, pod2)
+	play := expect.Script{
+		expect.PutData("/", expect.MustRoundTrip(t, map[string]interface{}{
+			"ns1": map[string]interface{}{"pod1": pod1},
+		})).End(),
+	}
+
+	expect.Play(t, play, func(ctx context.Context, mockClient *expect.Client) {
+		NewFromInterface(client, mockClient, resourceType, WithLabelSelector("app=web")).RunContext(ctx)
+	})
+}
+
+func TestGenericSync_fieldSelectors(t *testing.T) {
+	tests := []struct {
+		name             string
+		fieldSelector    string
+		ignoreNamespaces []string
+		want             string
+	}{
+		{
+			name: "none",
+			want: "",
+		},
+		{
+			name:          "field selector",
+			fieldSelector: "type=kubernetes.io/tls",
+			want:          "type=kubernetes.io/tls",
+		},
+		{
+			name:             "field selector and ignored namespaces",
+			fieldSelector:    "type=kubernetes.io/tls",
+			ignoreNamespaces: []string{"kube-system"},
+			want:             "type=kubernetes.io/tls,metadata.namespace!=kube-system",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &GenericSync{
+				fieldSelector:    tt.fieldSelector,
+				ignoreNamespaces: tt.ignoreNamespaces,
+				ns:               types.ResourceType{Namespaced: true},
+			}
+			if got := s.fieldSelectors(); got != tt.want {
+				t.Errorf("GenericSync.fieldSelectors() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func testPod(name, namespace string) runtime.Object {
+	return &apiv1.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, ResourceVersion: "0"},
+	}
+}
+
+// testPodWith returns a test pod, changed by the given function, e.g. to
+// set its labels.
+func testPodWith(name, namespace string, change func(*apiv1.Pod)) runtime.Object {
+	pod := testPod(name, namespace)
+	change(pod.(*apiv1.Pod))
+	return pod
+}
+
+func testNamespace(name string, labels map[string]string) runtime.Object {
+	return &apiv1.Namespace{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Namespace"},
+		ObjectMeta: metav1.ObjectMeta{Name: name, ResourceVersion: "0", Labels: labels},
+	}
+}
+
+func TestGenericSyncNamespaces(t *testing.T) {
+	t.Parallel()
+
+	resourceType := types.ResourceType{Namespaced: true, Resource: "pods", Version: "v1"}
+	client := newFakeDynamicClient(t, testPod("pod1", "ns1"), testPod("pod1", "ns2"), testPod("pod1", "ns3"))
+	play := expect.Script{
+		expect.PutData("/", expect.MustRoundTrip(t, map[string]interface{}{
+			"ns1": map[string]interface{}{"pod1": testPod("pod1", "ns1")},
+			"ns3": map[string]interface{}{"pod1": testPod("pod1", "ns3")},
+		})).End(),
+	}
+
+	expect.Play(t, play, func(ctx context.Context, mockClient *expect.Client) {
+		NewFromInterface(client, mockClient, resourceType, WithNamespaces([]string{"ns1", "ns3"})).RunContext(ctx)
+	})
+}
+
+func TestGenericSyncNamespaceSelector(t *testing.T) {
+	t.Parallel()
+
+	resourceType := types.ResourceType{Namespaced: true, Resource: "pods", Version: "v1"}
+	selected := map[string]string{"opa-replicate": "true"}
+	client := newFakeDynamicClient(t,
+		testNamespace("ns1", selected), testNamespace("ns2", nil),
+		testPod("pod1", "ns1"), testPod("pod1", "ns2"),
+	)
+
+	label := mustUnstructure(t, testNamespace("ns2", selected))
+	label.SetResourceVersion("1")
+	unlabel := mustUnstructure(t, testNamespace("ns1", nil))
+	unlabel.SetResourceVersion("1")
+
+	play := expect.Script{
+		expect.PutData("/", expect.MustRoundTrip(t, map[string]interface{}{
+			"ns1": map[string]interface{}{"pod1": testPod("pod1", "ns1")},
+		})).Do(client.MustUpdate(t, namespaceResource, label)),
+		expect.PutData("ns2/pod1", expect.MustRoundTrip(t, testPod("pod1", "ns2"))).Do(client.MustUpdate(t, namespaceResource, unlabel)),
+		expect.PatchData("ns1/pod1", "remove").End(),
+	}
+
+	expect.Play(t, play, func(ctx context.Context, mockClient *expect.Client) {
+		NewFromInterface(client, mockClient, resourceType, WithNamespaceSelector("opa-replicate=true")).RunContext(ctx)
+	})
+}
+
+func TestGenericSyncMetadataOnly(t *testing.T) {
+	t.Parallel()
+
+	resourceType := types.ResourceType{Namespaced: true, Resource: "pods", Version: "v1"}
+	sc := metadatafake.NewTestScheme()
+	if err := metav1.AddMetaToScheme(sc); err != nil {
+		t.Fatal(err)
+	}
+	meta := &metav1.PartialObjectMetadata{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "pod1",
+			Namespace:       "ns1",
+			ResourceVersion: "0",
+			Labels:          map[string]string{"app": "web"},
+			ManagedFields:   []metav1.ManagedFieldsEntry{{Manager: "kubectl"}},
+		},
+	}
+	metadataClient := metadatafake.NewSimpleMetadataClient(sc, meta)
+
+	expected := `{
+		"ns1": {
+			"pod1": {
+				"metadata": {
+					"creationTimestamp": null,
+					"labels": {"app": "web"},
+					"name": "pod1",
+					"namespace": "ns1",
+					"resourceVersion": "0"
+				}
+			}
+		}
+	}`
+	play := expect.Script{
+		expect.PutData("/", expect.MustRoundTrip(t, expect.MustUnmarshal(t, []byte(expected)))).End(),
+	}
+
+	expect.Play(t, play, func(ctx context.Context, mockClient *expect.Client) {
+		NewFromInterface(newFakeDynamicClient(t), mockClient, resourceType, WithMetadataOnly(metadataClient)).RunContext(ctx)
+	})
+}
+
+func TestGenericSyncCancelBeforeCacheSync(t *testing.T) {
+	t.Parallel()
+
+	sc := runtime.NewScheme()
+	if err := scheme.AddToScheme(sc); err != nil {
+		t.Fatalf("Failed to build initial scheme: %v", err)
+	}
+	fakeClient := fake.NewSimpleDynamicClient(sc)
+	fakeClient.PrependReactor("list", "*", func(clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("unavailable")
+	})
+
+	resourceType := types.ResourceType{Namespaced: true, Resource: "pods", Version: "v1"}
+	informers := NewInformers()
+	play := expect.Script{
+		expect.Nothing(100 * time.Millisecond).End(),
+	}
+
+	expect.Play(t, play, func(ctx context.Context, mockClient *expect.Client) {
+		s := NewFromInterface(dynamicClient{resourceInterface: fakeClient}, mockClient, resourceType, WithInformers(informers))
+		if err := s.RunContext(ctx); !errors.Is(err, context.Canceled) {
+			t.Fatalf("Expected context cancellation but got: %v", err)
+		}
+	})
+	if n := informers.len(); n != 0 {
+		t.Fatalf("Expected informers to be stopped but got %d running", n)
+	}
+}
+
+func TestGenericSyncSharedInformers(t *testing.T) {
+	t.Parallel()
+
+	resourceType := types.ResourceType{Namespaced: true, Resource: "pods", Version: "v1"}
+	client := newFakeDynamicClient(t, testPod("pod1", "ns1"))
+	informers := NewInformers()
+	var shared int
+	play := expect.Script{
+		expect.PutData("/").Do(nil),
+		expect.PutData("/").Do(func() error {
+			shared = informers.len()
+			return nil
+		}),
+	}
+
+	expect.Play(t, play, func(ctx context.Context, mockClient *expect.Client) {
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			s := NewFromInterface(client, mockClient, resourceType, WithInformers(informers))
+			go func() {
+				defer wg.Done()
+				s.RunContext(ctx)
+			}()
+		}
+		wg.Wait()
+	})
+	if shared != 1 {
+		t.Fatalf("Expected a single shared informer but got %d", shared)
+	}
+	if n := informers.len(); n != 0 {
+		t.Fatalf("Expected informers to be stopped but got %d running", n)
+	}
+}
+
+func TestGenericSyncBatching(t *testing.T) {
+	t.Parallel()
+
+	resourceType := types.ResourceType{Namespaced: true, Resource: "pods", Version: "v1"}
+	client := newFakeDynamicClient(t, testPod("pod1", "ns1"))
+	create := func() error {
+		if err := client.MustCreate(t, resourceType, testPod("pod2", "ns1"))(); err != nil {
+			return err
+		}
+		return client.MustCreate(t, resourceType, testPod("pod1", "ns2"))()
+	}
+	play := expect.Script{
+		expect.PutData("/").Do(create),
+		expect.PatchDataOps(expect.MustRoundTrip(t, []interface{}{
+			map[string]interface{}{"op": "add", "path": "ns1/pod2", "value": testPod("pod2", "ns1")},
+			map[string]interface{}{"op": "add", "path": "ns2", "value": map[string]interface{}{
+				"pod1": testPod("pod1", "ns2"),
+			}},
+		})).Do(client.MustRemove(t, resourceType, testPod("pod1", "ns1"))),
+		expect.PatchDataOps(expect.MustRoundTrip(t, []interface{}{
+			map[string]interface{}{"op": "remove", "path": "ns1/pod1"},
+		})).End(),
+	}
+
+	expect.Play(t, play, func(ctx context.Context, mockClient *expect.Client) {
+		NewFromInterface(client, mockClient, resourceType, WithBatching(100*time.Millisecond)).RunContext(ctx)
+	})
+}
+
+func TestGenericSyncBatchingShutdown(t *testing.T) {
+	t.Parallel()
+
+	resourceType := types.ResourceType{Namespaced: true, Resource: "pods", Version: "v1"}
+	client := newFakeDynamicClient(t, testPod("pod1", "ns1"))
+	play := expect.Script{
+		expect.PutData("/").Do(client.MustCreate(t, resourceType, testPod("pod2", "ns1"))),
+		expect.Nothing(100 * time.Millisecond).End(),
+	}
+
+	expect.Play(t, play, func(ctx context.Context, mockClient *expect.Client) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			NewFromInterface(client, mockClient, resourceType, WithBatching(time.Hour)).RunContext(ctx)
+		}()
+		<-ctx.Done()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Error("Expected sync to stop without waiting for the flush interval")
+		}
+	})
+}
+
+func TestGenericSyncKeyTemplate(t *testing.T) {
+	t.Parallel()
+
+	pod1 := testPodWith("pod1", "ns1", func(p *apiv1.Pod) { p.Labels = map[string]string{"app": "web"} })
+	pod2 := testPodWith("pod2", "ns2", func(p *apiv1.Pod) { p.Labels = map[string]string{"app": "web"} })
+	pod3 := testPod("pod3", "ns1")
+	pod4 := testPodWith("pod4", "ns1", func(p *apiv1.Pod) { p.Labels = map[string]string{"app": "db"} })
+
+	keyTemplate, err := NewKeyTemplate(`{{index .metadata.labels "app"}}`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	resourceType := types.ResourceType{Namespaced: true, Resource: "pods", Version: "v1"}
+	client := newFakeDynamicClient(t, pod1, pod2, pod3, pod4)
+	play := expect.Script{
+		expect.PutData("/", expect.MustRoundTrip(t, map[string]interface{}{
+			"db":  pod4,
+			"web": []interface{}{pod1, pod2},
+		})).Do(client.MustRemove(t, resourceType, pod2)),
+		expect.PutData("web", expect.MustRoundTrip(t, pod1)).Do(client.MustRemove(t, resourceType, pod4)),
+		expect.PatchData("db", "remove").End(),
+	}
+
+	expect.Play(t, play, func(ctx context.Context, mockClient *expect.Client) {
+		NewFromInterface(client, mockClient, resourceType, WithKeyTemplate(keyTemplate)).RunContext(ctx)
+	})
+}
+
+func TestGenericSyncKeyTemplateConflicts(t *testing.T) {
+	t.Parallel()
+
+	pod1 := testPodWith("pod1", "ns1", func(p *apiv1.Pod) { p.Annotations = map[string]string{"path": "a"} })
+	pod2 := testPodWith("pod2", "ns1", func(p *apiv1.Pod) { p.Annotations = map[string]string{"path": "a/b"} })
+	pod3 := testPodWith("pod3", "ns1", func(p *apiv1.Pod) { p.Annotations = map[string]string{"path": "a/c"} })
+	pod4 := testPodWith("pod4", "ns1", func(p *apiv1.Pod) { p.Annotations = map[string]string{"path": "d"} })
+
+	keyTemplate, err := NewKeyTemplate(`{{index .metadata.annotations "path"}}`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Objects nested under the key of another object are not replicated,
+	// until that object is removed
+	resourceType := types.ResourceType{Namespaced: true, Resource: "pods", Version: "v1"}
+	client := newFakeDynamicClient(t, pod1, pod2)
+	create := func() error {
+		if err := client.MustCreate(t, resourceType, pod3)(); err != nil {
+			return err
+		}
+		return client.MustCreate(t, resourceType, pod4)()
+	}
+	play := expect.Script{
+		expect.PutData("/", expect.MustRoundTrip(t, map[string]interface{}{
+			"a": pod1,
+		})).Do(create),
+		expect.PutData("d", expect.MustRoundTrip(t, pod4)).Do(client.MustRemove(t, resourceType, pod1)),
+		expect.PatchData("a", "remove").End(),
+		expect.PutData("a/b", expect.MustRoundTrip(t, pod2)).End(),
+		expect.PutData("a/c", expect.MustRoundTrip(t, pod3)).End(),
+	}
+
+	expect.Play(t, play, func(ctx context.Context, mockClient *expect.Client) {
+		NewFromInterface(client, mockClient, resourceType, WithKeyTemplate(keyTemplate)).RunContext(ctx)
+	})
+}
+
+func TestGenericSyncKeyTemplateEscaping(t *testing.T) {
+	t.Parallel()
+
+	pod1 := testPodWith("pod1", "ns1", func(p *apiv1.Pod) { p.Annotations = map[string]string{"path": "a b/c~d%e"} })
+
+	keyTemplate, err := NewKeyTemplate(`{{index .metadata.annotations "path"}}`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Keys are escaped in URL paths and JSON pointers
+	resourceType := types.ResourceType{Namespaced: true, Resource: "pods", Version: "v1"}
+	client := newFakeDynamicClient(t)
+	play := expect.Script{
+		expect.PutData("/").Do(client.MustCreate(t, resourceType, pod1)),
+		expect.PutData("a%20b/c~d%25e", expect.MustRoundTrip(t, pod1)).Do(client.MustRemove(t, resourceType, pod1)),
+		expect.PatchData("a b/c~0d%25e", "remove").End(),
+	}
+
+	expect.Play(t, play, func(ctx context.Context, mockClient *expect.Client) {
+		NewFromInterface(client, mockClient, resourceType, WithKeyTemplate(keyTemplate)).RunContext(ctx)
+	})
+}
+
+func TestGenericSyncIndexes(t *testing.T) {
+	t.Parallel()
+
+	pod1 := testPodWith("pod1", "ns1", func(p *apiv1.Pod) { p.Spec.ServiceAccountName = "a" })
+	pod2 := testPodWith("pod2", "ns2", func(p *apiv1.Pod) { p.Spec.ServiceAccountName = "a" })
+	pod3 := testPodWith("pod3", "ns1", func(p *apiv1.Pod) { p.Spec.ServiceAccountName = "b/c" })
+
+	index, err := NewIndex("serviceAccount", "spec.serviceAccountName")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	resourceType := types.ResourceType{Namespaced: true, Resource: "pods", Version: "v1"}
+	client := newFakeDynamicClient(t, pod1, pod2)
+	play := expect.Script{
+		expect.PutData("/").End(),
+		expect.PutData("/", expect.MustRoundTrip(t, map[string]interface{}{
+			"serviceAccount": map[string]interface{}{
+				"a": []interface{}{
+					map[string]interface{}{"namespace": "ns1", "name": "pod1"},
+					map[string]interface{}{"namespace": "ns2", "name": "pod2"},
+				},
+			},
+		})).Do(client.MustCreate(t, resourceType, pod3)),
+		expect.PutData("ns1/pod3").End(),
+		expect.PatchDataOps(expect.MustRoundTrip(t, []interface{}{
+			map[string]interface{}{"op": "add", "path": "serviceAccount/b~1c", "value": []interface{}{
+				map[string]interface{}{"namespace": "ns1", "name": "pod3"},
+			}},
+		})).Do(client.MustRemove(t, resourceType, pod1)),
+		expect.PatchData("ns1/pod1", "remove").End(),
+		expect.PatchDataOps(expect.MustRoundTrip(t, []interface{}{
+			map[string]interface{}{"op": "add", "path": "serviceAccount/a", "value": []interface{}{
+				map[string]interface{}{"namespace": "ns2", "name": "pod2"},
+			}},
+		})).End(),
+	}
+
+	data := expect.Play(t, play, func(ctx context.Context, mockClient *expect.Client) {
+		NewFromInterface(client, mockClient, resourceType, WithIndexes(index)).RunContext(ctx)
+	})
+	expect.MustEqual(t, data.PrefixList, []string{"pods", IndexPath, "pods"})
+}
+
+func TestGenericSyncIndexesTransform(t *testing.T) {
+	t.Parallel()
+
+	pod1 := testPodWith("pod1", "ns1", func(p *apiv1.Pod) { p.Spec.ServiceAccountName = "a" })
+	pod2 := testPodWith("pod2", "ns2", func(p *apiv1.Pod) { p.Spec.ServiceAccountName = "a" })
+	pod3 := testPodWith("pod3", "ns2", func(p *apiv1.Pod) { p.Spec.ServiceAccountName = "b" })
+	pod4 := testPodWith("pod4", "ns1", func(p *apiv1.Pod) { p.Spec.ServiceAccountName = "b" })
+
+	index, err := NewIndex("serviceAccount", "spec.serviceAccountName")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// Drop the pods of ns2, which must not be indexed either
+	transform := transformFunc(func(obj interface{}) (interface{}, error) {
+		metadata := obj.(map[string]interface{})["metadata"].(map[string]interface{})
+		if metadata["namespace"] == "ns2" {
+			return nil, nil
+		}
+		return obj, nil
+	})
+
+	// Dropped pods, never replicated, are not removed either
+	resourceType := types.ResourceType{Namespaced: true, Resource: "pods", Version: "v1"}
+	client := newFakeDynamicClient(t, pod1, pod2)
+	create := func() error {
+		if err := client.MustCreate(t, resourceType, pod3)(); err != nil {
+			return err
+		}
+		return client.MustCreate(t, resourceType, pod4)()
+	}
+	play := expect.Script{
+		expect.PutData("/").End(),
+		expect.PutData("/", expect.MustRoundTrip(t, map[string]interface{}{
+			"serviceAccount": map[string]interface{}{
+				"a": []interface{}{
+					map[string]interface{}{"namespace": "ns1", "name": "pod1"},
+				},
+			},
+		})).Do(create),
+		expect.PutData("ns1/pod4").End(),
+		expect.PatchDataOps(expect.MustRoundTrip(t, []interface{}{
+			map[string]interface{}{"op": "add", "path": "serviceAccount/b", "value": []interface{}{
+				map[string]interface{}{"namespace": "ns1", "name": "pod4"},
+			}},
+		})).End(),
+	}
+
+	expect.Play(t, play, func(ctx context.Context, mockClient *expect.Client) {
+		NewFromInterface(client, mockClient, resourceType, WithIndexes(index), WithTransform(transform)).RunContext(ctx)
+	})
+}
@@ -0,0 +1,273 @@
+// Copyright 2017 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package data
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	opa_client "github.com/open-policy-agent/kube-mgmt/pkg/opa"
+
+	"k8s.io/client-go/tools/cache"
+)
+
+// IndexPath is the path, under the replicate path, where index documents
+// are replicated: <replicate-path>/_index/<resource>/<index>/<value>
+const IndexPath = "_index"
+
+// Index maps the values found at a field path of objects to the objects
+// holding them, e.g. ingresses by spec.rules[*].host, or pods by
+// spec.serviceAccountName.
+type Index struct {
+	name string
+	path []pathSegment
+}
+
+// NewIndex returns an index named name, on the values found at the field
+// path. Paths use the same syntax as projections.
+func NewIndex(name, path string) (*Index, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return nil, fmt.Errorf("invalid index name %q", name)
+	}
+	segments, err := parseFieldPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Index{name: name, path: segments}, nil
+}
+
+// values returns the distinct scalar values found at the path, as strings
+func (i *Index) values(obj interface{}) []string {
+	seen := map[string]struct{}{}
+	collectValues(templateData(obj), i.path, seen)
+	result := make([]string, 0, len(seen))
+	for value := range seen {
+		result = append(result, value)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func collectValues(value interface{}, path []pathSegment, result map[string]struct{}) {
+	if len(path) == 0 {
+		switch v := value.(type) {
+		case string:
+			result[v] = struct{}{}
+		case bool, int64, float64:
+			result[fmt.Sprint(v)] = struct{}{}
+		case []interface{}: // e.g. a list of finalizers
+			for _, elem := range v {
+				collectValues(elem, nil, result)
+			}
+		}
+		return
+	}
+	segment := path[0]
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if segment.wildcard {
+			for _, field := range v {
+				collectValues(field, path[1:], result)
+			}
+		} else if field, ok := v[segment.name]; ok {
+			collectValues(field, path[1:], result)
+		}
+	case []interface{}:
+		if segment.wildcard {
+			for _, elem := range v {
+				collectValues(elem, path[1:], result)
+			}
+		} else if n, err := strconv.Atoi(segment.name); err == nil && n >= 0 && n < len(v) {
+			collectValues(v[n], path[1:], result)
+		}
+	}
+}
+
+// indexes maintains the index documents of a GenericSync in memory, so
+// that only the values affected by an event are written into OPA.
+type indexes struct {
+	defs     []*Index
+	entries  map[string]map[string]map[string]struct{} // index to value to store keys
+	byObject map[string]map[string][]string            // store key to index to values
+	dirty    map[string]map[string]struct{}            // index to values to write into OPA
+}
+
+func newIndexes(defs []*Index) *indexes {
+	x := &indexes{
+		defs:     defs,
+		entries:  map[string]map[string]map[string]struct{}{},
+		byObject: map[string]map[string][]string{},
+		dirty:    map[string]map[string]struct{}{},
+	}
+	for _, def := range defs {
+		x.entries[def.name] = map[string]map[string]struct{}{}
+		x.dirty[def.name] = map[string]struct{}{}
+	}
+	return x
+}
+
+// set indexes the object stored at the key, or removes it if obj is nil.
+// The values the object is added to or removed from are marked dirty.
+func (x *indexes) set(storeKey string, obj interface{}) {
+	prev := x.byObject[storeKey]
+	delete(x.byObject, storeKey)
+	for _, def := range x.defs {
+		for _, value := range prev[def.name] {
+			delete(x.entries[def.name][value], storeKey)
+			if len(x.entries[def.name][value]) == 0 {
+				delete(x.entries[def.name], value)
+			}
+			x.dirty[def.name][value] = struct{}{}
+		}
+		if obj == nil {
+			continue
+		}
+		values := def.values(obj)
+		if len(values) == 0 {
+			continue
+		}
+		if x.byObject[storeKey] == nil {
+			x.byObject[storeKey] = map[string][]string{}
+		}
+		x.byObject[storeKey][def.name] = values
+		for _, value := range values {
+			if x.entries[def.name][value] == nil {
+				x.entries[def.name][value] = map[string]struct{}{}
+			}
+			x.entries[def.name][value][storeKey] = struct{}{}
+			x.dirty[def.name][value] = struct{}{}
+		}
+	}
+}
+
+// refs returns the objects holding the value, sorted by namespace and name
+func (x *indexes) refs(index, value string) []interface{} {
+	keys := make([]string, 0, len(x.entries[index][value]))
+	for key := range x.entries[index][value] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		namespace, name, err := cache.SplitMetaNamespaceKey(key)
+		if err != nil {
+			continue
+		}
+		ref := map[string]interface{}{"name": name}
+		if namespace != "" {
+			ref["namespace"] = namespace
+		}
+		result = append(result, ref)
+	}
+	return result
+}
+
+// document returns all index documents, for a full load.
+func (x *indexes) document() map[string]interface{} {
+	doc := make(map[string]interface{}, len(x.defs))
+	for _, def := range x.defs {
+		values := make(map[string]interface{}, len(x.entries[def.name]))
+		for value := range x.entries[def.name] {
+			values[value] = x.refs(def.name, value)
+		}
+		doc[def.name] = values
+	}
+	return doc
+}
+
+// patch returns the operations writing the dirty values into OPA.
+func (x *indexes) patch() []opa_client.PatchOp {
+	var ops []opa_client.PatchOp
+	for _, def := range x.defs {
+		values := make([]string, 0, len(x.dirty[def.name]))
+		for value := range x.dirty[def.name] {
+			values = append(values, value)
+		}
+		sort.Strings(values)
+		for _, value := range values {
+			path := def.name + "/" + escapePointer(value)
+			if _, ok := x.entries[def.name][value]; !ok {
+				ops = append(ops, opa_client.PatchOp{Op: "remove", Path: path})
+				continue
+			}
+			var refs interface{} = x.refs(def.name, value)
+			ops = append(ops, opa_client.PatchOp{Op: "add", Path: path, Value: &refs})
+		}
+	}
+	return ops
+}
+
+// clean marks all values as written into OPA.
+func (x *indexes) clean() {
+	for _, def := range x.defs {
+		x.dirty[def.name] = map[string]struct{}{}
+	}
+}
+
+// escapePointer escapes the value for use as a JSON Pointer segment. OPA
+// also URL-decodes patch paths, so '%' is escaped too.
+var escapePointer = strings.NewReplacer("~", "~0", "/", "~1", "%", "%25").Replace
+
+// setDropped records whether the object stored at the key was dropped
+// rather than replicated, e.g. by a transform, so that indexes leave it out
+// and only refer to objects found in OPA.
+func (s *GenericSync) setDropped(key string, dropped bool) {
+	if s.indexes == nil {
+		return
+	}
+	if dropped {
+		s.dropped[key] = struct{}{}
+	} else {
+		delete(s.dropped, key)
+	}
+}
+
+// processIndexes updates the index documents for the objects stored at the
+// keys with a single patch.
+func (s *GenericSync) processIndexes(store objectStore, keys []interface{}) error {
+	for _, k := range keys {
+		key := k.(string)
+		obj, exists, err := store.GetByKey(key)
+		if err != nil {
+			return fmt.Errorf("store error: %w", err)
+		}
+		if _, dropped := s.dropped[key]; !exists || dropped {
+			obj = nil
+		}
+		s.indexes.set(key, obj)
+	}
+	ops := s.indexes.patch()
+	if len(ops) == 0 {
+		return nil
+	}
+	if err := opa_client.PatchDataOps(s.indexData, ops); err != nil {
+		return fmt.Errorf("index event: %w", err)
+	}
+	s.indexes.clean()
+	return nil
+}
+
+// syncIndexes indexes all objects, and replaces the index documents in OPA.
+func (s *GenericSync) syncIndexes(objs []interface{}) error {
+	x := newIndexes(s.indexes.defs)
+	for _, obj := range objs {
+		key, err := cache.MetaNamespaceKeyFunc(obj)
+		if err != nil {
+			return err
+		}
+		if _, dropped := s.dropped[key]; dropped {
+			continue
+		}
+		x.set(key, obj)
+	}
+	x.clean()
+	if err := s.indexData.PutData("/", x.document()); err != nil {
+		return fmt.Errorf("index load: %w", err)
+	}
+	s.indexes = x
+	return nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2017 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package data
+
+import (
+	"context"
+	"sync"
+
+	"github.com/open-policy-agent/kube-mgmt/pkg/types"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Informers shares informers between GenericSync instances, so that each
+// resource is listed, watched and cached once no matter how many instances
+// replicate it. An informer is started by its first consumer, and stopped
+// when its last consumer goes away.
+//
+// Instances sharing Informers must use the same Kubernetes clients.
+type Informers struct {
+	mu        sync.Mutex
+	informers map[informerKey]*sharedInformer
+}
+
+// NewInformers returns an empty set of shared informers.
+func NewInformers() *Informers {
+	return &Informers{informers: map[informerKey]*sharedInformer{}}
+}
+
+// informerKey identifies the objects watched by an informer
+type informerKey struct {
+	resourceType  types.ResourceType
+	namespace     string
+	fieldSelector string
+	labelSelector string
+	metadataOnly  bool
+}
+
+type sharedInformer struct {
+	informer cache.SharedIndexInformer
+	cancel   context.CancelFunc
+	refs     int
+}
+
+// listWatchFunc builds the ListerWatcher of an informer. The context is
+// cancelled when the informer is stopped.
+type listWatchFunc func(ctx context.Context) cache.ListerWatcher
+
+// acquire registers the handler on the informer for the key, starting the
+// informer if needed. The returned function unregisters the handler, and
+// stops the informer if it was the last one.
+func (i *Informers) acquire(key informerKey, listWatch listWatchFunc, objType runtime.Object, handler cache.ResourceEventHandler) (cache.SharedIndexInformer, cache.ResourceEventHandlerRegistration, func(), error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	shared, ok := i.informers[key]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		informer := cache.NewSharedIndexInformer(listWatch(ctx), objType, 0, cache.Indexers{})
+		shared = &sharedInformer{informer: informer, cancel: cancel}
+		i.informers[key] = shared
+		logrus.Debugf("Starting informer for %v", key)
+		go informer.Run(ctx.Done())
+	}
+
+	registration, err := shared.informer.AddEventHandler(handler)
+	if err != nil {
+		if shared.refs == 0 {
+			i.stop(key, shared)
+		}
+		return nil, nil, nil, err
+	}
+	shared.refs++
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			i.mu.Lock()
+			defer i.mu.Unlock()
+			if err := shared.informer.RemoveEventHandler(registration); err != nil {
+				logrus.Warnf("Failed to remove event handler from informer for %v: %v", key, err)
+			}
+			shared.refs--
+			if shared.refs == 0 {
+				i.stop(key, shared)
+			}
+		})
+	}
+	return shared.informer, registration, release, nil
+}
+
+// stop the informer, assumes the lock is held
+func (i *Informers) stop(key informerKey, shared *sharedInformer) {
+	logrus.Debugf("Stopping informer for %v", key)
+	shared.cancel()
+	if i.informers[key] == shared {
+		delete(i.informers, key)
+	}
+}
+
+// len returns the number of running informers
+func (i *Informers) len() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return len(i.informers)
+}
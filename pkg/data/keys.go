@@ -0,0 +1,325 @@
+// Copyright 2017 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package data
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"text/template"
+
+	opa_client "github.com/open-policy-agent/kube-mgmt/pkg/opa"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// KeyTemplate lays out replicated objects by the result of a text/template
+// evaluated against each object, e.g. "{{.metadata.uid}}" or
+// "{{.metadata.namespace}}/{{index .metadata.labels \"app\"}}", rather than
+// by namespace and name. Slashes in the result nest the object in OPA.
+type KeyTemplate struct {
+	tmpl *template.Template
+}
+
+// NewKeyTemplate parses the template text.
+func NewKeyTemplate(text string) (*KeyTemplate, error) {
+	tmpl, err := template.New("key").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyTemplate{tmpl: tmpl}, nil
+}
+
+// Key returns the path of the object, or false if the template does not
+// apply to it, e.g. when the object lacks the label it refers to.
+func (k *KeyTemplate) Key(obj interface{}) (string, bool) {
+	var b strings.Builder
+	if err := k.tmpl.Execute(&b, templateData(obj)); err != nil {
+		logrus.Debugf("Failed to evaluate key template: %v", err)
+		return "", false
+	}
+	key := strings.TrimSpace(b.String())
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "<no value>" {
+			return "", false
+		}
+	}
+	return key, true
+}
+
+// templateData returns the object as a generic document
+func templateData(obj interface{}) interface{} {
+	switch o := obj.(type) {
+	case *unstructured.Unstructured:
+		return o.Object
+	case *metav1.PartialObjectMetadata:
+		return metadataObject(o)
+	case runtime.Object:
+		if u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(o); err == nil {
+			return u
+		}
+	}
+	return obj
+}
+
+// keyGroup holds the objects sharing a template key, sorted by store key.
+type keyGroup struct {
+	keys []string
+	objs []interface{}
+}
+
+// templateKeys tracks which objects are replicated under each template key.
+type templateKeys struct {
+	byObject map[string]string              // store key to template key
+	objects  map[string]map[string]struct{} // template key to store keys
+	parents  map[string]int                 // parents of the template keys, e.g. a for a/b
+	refused  map[string]string              // store key to the template key it conflicts with
+	requeue  map[string]struct{}            // refused store keys to process again
+	dirty    map[string]struct{}            // template keys to write into OPA
+}
+
+func newTemplateKeys() *templateKeys {
+	return &templateKeys{
+		byObject: map[string]string{},
+		objects:  map[string]map[string]struct{}{},
+		parents:  map[string]int{},
+		refused:  map[string]string{},
+		requeue:  map[string]struct{}{},
+		dirty:    map[string]struct{}{},
+	}
+}
+
+// set moves the object to a new template key, or removes it if !ok. Both
+// the previous and the new template keys must then be written. Objects are
+// removed too if their key conflicts with the keys of other objects, which
+// is returned as an error. They are queued again once the conflicting key
+// is released.
+func (t *templateKeys) set(storeKey, key string, ok bool) error {
+	delete(t.refused, storeKey)
+	if prev, found := t.byObject[storeKey]; found {
+		if ok && prev == key {
+			t.dirty[key] = struct{}{}
+			return nil
+		}
+		delete(t.objects[prev], storeKey)
+		if len(t.objects[prev]) == 0 {
+			delete(t.objects, prev)
+			t.release(prev)
+			t.countParents(prev, -1)
+		}
+		delete(t.byObject, storeKey)
+		t.dirty[prev] = struct{}{}
+	}
+	if !ok {
+		return nil
+	}
+	if conflict, err := t.check(key); err != nil {
+		t.refused[storeKey] = conflict
+		return err
+	}
+	t.byObject[storeKey] = key
+	if t.objects[key] == nil {
+		t.objects[key] = map[string]struct{}{}
+		t.countParents(key, 1)
+	}
+	t.objects[key][storeKey] = struct{}{}
+	t.dirty[key] = struct{}{}
+	return nil
+}
+
+// check returns an error if objects are replicated under the key, or under
+// one of its parents, e.g. under a for a/b: OPA cannot hold both. The key
+// to be released for the check to pass is returned along with the error.
+func (t *templateKeys) check(key string) (string, error) {
+	if t.parents[key] > 0 {
+		return key, fmt.Errorf("key %q holds the keys of other objects", key)
+	}
+	for i := strings.Index(key, "/"); i >= 0; i = nextSlash(key, i) {
+		if _, ok := t.objects[key[:i]]; ok {
+			return key[:i], fmt.Errorf("key %q is nested under the key %q of other objects", key, key[:i])
+		}
+	}
+	return "", nil
+}
+
+func (t *templateKeys) countParents(key string, delta int) {
+	for i := strings.Index(key, "/"); i >= 0; i = nextSlash(key, i) {
+		if t.parents[key[:i]] += delta; t.parents[key[:i]] <= 0 {
+			delete(t.parents, key[:i])
+			t.release(key[:i])
+		}
+	}
+}
+
+// release queues the objects refused for conflicting with the key again,
+// now that no objects are replicated under or within it.
+func (t *templateKeys) release(key string) {
+	for storeKey, conflict := range t.refused {
+		if conflict == key {
+			delete(t.refused, storeKey)
+			t.requeue[storeKey] = struct{}{}
+		}
+	}
+}
+
+// nextSlash returns the index of the next slash in the key after i, or -1
+func nextSlash(key string, i int) int {
+	if j := strings.Index(key[i+1:], "/"); j >= 0 {
+		return i + 1 + j
+	}
+	return -1
+}
+
+// escapeKey escapes each segment of the template key, made of values of the
+// objects, for a URL path or a JSON pointer.
+func escapeKey(key string, escape func(string) string) string {
+	segments := strings.Split(key, "/")
+	for i := range segments {
+		segments[i] = escape(segments[i])
+	}
+	return strings.Join(segments, "/")
+}
+
+// group returns the objects under the template key, read from the store
+func (t *templateKeys) group(store objectStore, key string) (keyGroup, error) {
+	var g keyGroup
+	for storeKey := range t.objects[key] {
+		g.keys = append(g.keys, storeKey)
+	}
+	sort.Strings(g.keys)
+	for _, storeKey := range g.keys {
+		obj, _, err := store.GetByKey(storeKey)
+		if err != nil {
+			return g, err
+		}
+		g.objs = append(g.objs, obj) // nil if deleted since
+	}
+	return g, nil
+}
+
+// templateGroups groups the objects by template key, for a full load. Of
+// conflicting keys, e.g. a and a/b, the parent is replicated.
+func templateGroups(k *KeyTemplate, objs []interface{}) (*templateKeys, map[string]*keyGroup, error) {
+	type keyedObject struct {
+		storeKey, key string
+		obj           interface{}
+	}
+	keyed := make([]keyedObject, 0, len(objs))
+	for _, obj := range objs {
+		storeKey, err := cache.MetaNamespaceKeyFunc(obj)
+		if err != nil {
+			return nil, nil, err
+		}
+		if key, ok := k.Key(obj); ok {
+			keyed = append(keyed, keyedObject{storeKey: storeKey, key: key, obj: obj})
+		}
+	}
+	// Parents sort before the keys nested under them
+	sort.Slice(keyed, func(i, j int) bool { return keyed[i].key < keyed[j].key })
+
+	keys, groups := newTemplateKeys(), map[string]*keyGroup{}
+	for _, x := range keyed {
+		storeKey, key, obj := x.storeKey, x.key, x.obj
+		if err := keys.set(storeKey, key, true); err != nil {
+			logrus.Errorf("Not replicating %v: %v", storeKey, err)
+			continue
+		}
+		if groups[key] == nil {
+			groups[key] = &keyGroup{}
+		}
+		groups[key].keys = append(groups[key].keys, storeKey)
+		groups[key].objs = append(groups[key].objs, obj)
+	}
+	keys.dirty = map[string]struct{}{}
+	for _, g := range groups {
+		sort.Sort(g)
+	}
+	return keys, groups, nil
+}
+
+func (g *keyGroup) Len() int           { return len(g.keys) }
+func (g *keyGroup) Less(i, j int) bool { return g.keys[i] < g.keys[j] }
+func (g *keyGroup) Swap(i, j int) {
+	g.keys[i], g.keys[j] = g.keys[j], g.keys[i]
+	g.objs[i], g.objs[j] = g.objs[j], g.objs[i]
+}
+
+// prepareGroup returns the value replicated for a template key: the object
+// if only one is replicated under it, or an array of them on collisions.
+func (s *GenericSync) prepareGroup(_ string, obj interface{}) (interface{}, bool) {
+	g := obj.(*keyGroup)
+	var values []interface{}
+	for i, o := range g.objs {
+		if o == nil {
+			continue
+		}
+		if value, ok := s.prepare(g.keys[i], o); ok {
+			values = append(values, value)
+		}
+	}
+	switch len(values) {
+	case 0:
+		return nil, false
+	case 1:
+		return values[0], true
+	default:
+		return values, true
+	}
+}
+
+// processTemplateKey updates the template keys the object was and is now
+// replicated under, queueing the objects refused before if it released the
+// key they conflicted with.
+func (s *GenericSync) processTemplateKey(store objectStore, queue workqueue.Interface, storeKey string) error {
+	obj, exists, err := store.GetByKey(storeKey)
+	if err != nil {
+		return fmt.Errorf("store error: %w", err)
+	}
+	var key string
+	if exists {
+		key, exists = s.keyTemplate.Key(obj)
+	}
+	if err := s.keys.set(storeKey, key, exists); err != nil {
+		logrus.Errorf("Not replicating %v %v: %v", s.ns, storeKey, err)
+	}
+	requeue := make([]string, 0, len(s.keys.requeue))
+	for storeKey := range s.keys.requeue {
+		requeue = append(requeue, storeKey)
+	}
+	sort.Strings(requeue)
+	for _, storeKey := range requeue {
+		queue.Add(storeKey)
+		delete(s.keys.requeue, storeKey)
+	}
+
+	// Keys that failed to be written before are written again too
+	dirty := make([]string, 0, len(s.keys.dirty))
+	for key := range s.keys.dirty {
+		dirty = append(dirty, key)
+	}
+	sort.Strings(dirty)
+	for _, key := range dirty {
+		g, err := s.keys.group(store, key)
+		if err != nil {
+			return fmt.Errorf("store error: %w", err)
+		}
+		value, ok := s.prepareGroup(key, &g)
+		if !ok {
+			if err := s.opa.PatchData(escapeKey(key, escapePointer), "remove", nil); err != nil && !opa_client.IsNotFoundErr(err) {
+				return fmt.Errorf("delete event: %w", err)
+			}
+		} else if err := s.opa.PutData(escapeKey(key, url.PathEscape), value); err != nil {
+			return fmt.Errorf("add event: %w", err)
+		}
+		delete(s.keys.dirty, key)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package data
+
+import (
+	"testing"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestKeyTemplate(t *testing.T) {
+
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "pod1",
+			Namespace: "ns1",
+			UID:       "8d5a3c2e",
+			Labels:    map[string]string{"app": "web"},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: "ReplicaSet", Name: "web-5f8b"},
+			},
+		},
+	}
+
+	tests := []struct {
+		template string
+		key      string
+		ok       bool
+	}{
+		{template: "{{.metadata.uid}}", key: "8d5a3c2e", ok: true},
+		{template: `{{.metadata.namespace}}/{{index .metadata.labels "app"}}`, key: "ns1/web", ok: true},
+		{template: `{{with index .metadata.ownerReferences 0}}{{.kind}}/{{.name}}{{end}}`, key: "ReplicaSet/web-5f8b", ok: true},
+		{template: `{{index .metadata.labels "team"}}`},
+		{template: "{{.metadata.annotations.team}}"},
+		{template: "{{.metadata.namespace}}/"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.template, func(t *testing.T) {
+			keyTemplate, err := NewKeyTemplate(tc.template)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			key, ok := keyTemplate.Key(pod)
+			if key != tc.key || ok != tc.ok {
+				t.Fatalf("Expected (%q, %v) but got (%q, %v)", tc.key, tc.ok, key, ok)
+			}
+		})
+	}
+}
+
+func TestKeyTemplateInvalid(t *testing.T) {
+	if _, err := NewKeyTemplate("{{.metadata.uid"); err == nil {
+		t.Fatal("Expected error")
+	}
+}
+
+func TestTemplateKeysConflicts(t *testing.T) {
+
+	keys := newTemplateKeys()
+	mustSet := func(storeKey, key string, ok bool) {
+		t.Helper()
+		if err := keys.set(storeKey, key, ok); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	mustSet("ns1/pod1", "a/b", true)
+	mustSet("ns1/pod2", "a/b", true)
+	mustSet("ns1/pod3", "a/c", true)
+	for _, key := range []string{"a", "a/b/c", "a/c/d"} {
+		if err := keys.set("ns1/pod4", key, true); err == nil {
+			t.Fatalf("Expected %v to conflict", key)
+		}
+	}
+	if _, ok := keys.byObject["ns1/pod4"]; ok {
+		t.Fatal("Expected conflicting object not to be replicated")
+	}
+
+	// An object may move under its own key, once no other object uses it.
+	// Objects refused are queued again once the key conflicting is released.
+	mustSet("ns1/pod3", "a/c/d", true)
+	if _, ok := keys.requeue["ns1/pod4"]; !ok || len(keys.requeue) != 1 {
+		t.Fatalf("Expected ns1/pod4 to be queued again once a/c is released, got: %v", keys.requeue)
+	}
+	keys.requeue = map[string]struct{}{}
+	mustSet("ns1/pod1", "", false)
+	mustSet("ns1/pod2", "a/b/c", true)
+	if err := keys.set("ns1/pod4", "a", true); err == nil {
+		t.Fatal("Expected a to conflict")
+	}
+	mustSet("ns1/pod2", "b", true)
+	if len(keys.requeue) != 0 {
+		t.Fatalf("Expected no object to be queued again, got: %v", keys.requeue)
+	}
+	mustSet("ns1/pod3", "", false)
+	if _, ok := keys.requeue["ns1/pod4"]; !ok || len(keys.requeue) != 1 {
+		t.Fatalf("Expected ns1/pod4 to be queued again once a is released, got: %v", keys.requeue)
+	}
+	mustSet("ns1/pod4", "a", true)
+}
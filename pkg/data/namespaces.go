@@ -0,0 +1,169 @@
+// Copyright 2017 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package data
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/open-policy-agent/kube-mgmt/pkg/types"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+var namespaceResource = types.ResourceType{Version: "v1", Resource: "namespaces"}
+
+// objectStore is the read-only part of a cache.Store used for replication
+type objectStore interface {
+	List() []interface{}
+	ListKeys() []string
+	GetByKey(key string) (interface{}, bool, error)
+}
+
+// namespaceStores combines the stores of per-namespace informers
+type namespaceStores map[string]cache.Store
+
+func (s namespaceStores) List() []interface{} {
+	var result []interface{}
+	for _, store := range s {
+		result = append(result, store.List()...)
+	}
+	return result
+}
+
+func (s namespaceStores) ListKeys() []string {
+	var result []string
+	for _, store := range s {
+		result = append(result, store.ListKeys()...)
+	}
+	return result
+}
+
+func (s namespaceStores) GetByKey(key string) (interface{}, bool, error) {
+	namespace, _, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return nil, false, err
+	}
+	store, ok := s[namespace]
+	if !ok {
+		return nil, false, nil
+	}
+	return store.GetByKey(key)
+}
+
+// namespaceFilter tracks the namespaces matching a label selector. It is
+// the event handler of an informer on namespaces, and queues all objects
+// of a namespace when it starts or stops matching.
+type namespaceFilter struct {
+	mu       sync.RWMutex
+	matching map[string]struct{}
+	selector labels.Selector
+	store    objectStore
+	queue    workqueue.Interface
+}
+
+func newNamespaceFilter(selector labels.Selector, store objectStore, queue workqueue.Interface) *namespaceFilter {
+	return &namespaceFilter{
+		matching: map[string]struct{}{},
+		selector: selector,
+		store:    store,
+		queue:    queue,
+	}
+}
+
+func (f *namespaceFilter) Matches(namespace string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	_, ok := f.matching[namespace]
+	return ok
+}
+
+func (f *namespaceFilter) set(obj interface{}, deleted bool) {
+	if d, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = d.Obj
+	}
+	m, err := meta.Accessor(obj)
+	if err != nil {
+		logrus.Warnf("failed to retrieve meta: %v", err)
+		return
+	}
+	namespace := m.GetName()
+	matching := !deleted && f.selector.Matches(labels.Set(m.GetLabels()))
+
+	f.mu.Lock()
+	_, wasMatching := f.matching[namespace]
+	if matching {
+		f.matching[namespace] = struct{}{}
+	} else {
+		delete(f.matching, namespace)
+	}
+	f.mu.Unlock()
+
+	if wasMatching != matching {
+		logrus.Debugf("Namespace %v matching selector: %v", namespace, matching)
+		prefix := namespace + "/"
+		for _, key := range f.store.ListKeys() {
+			if strings.HasPrefix(key, prefix) {
+				f.queue.Add(key)
+			}
+		}
+	}
+}
+
+// OnAdd implements ResourceHandler
+func (f *namespaceFilter) OnAdd(obj interface{}, isInInitialList bool) {
+	f.set(obj, false)
+}
+
+// OnUpdate implements ResourceHandler
+func (f *namespaceFilter) OnUpdate(oldObj, newObj interface{}) {
+	f.set(newObj, false)
+}
+
+// OnDelete implements ResourceHandler
+func (f *namespaceFilter) OnDelete(obj interface{}) {
+	f.set(obj, true)
+}
+
+// filteredStore hides the objects of namespaces not matching the filter
+type filteredStore struct {
+	objectStore
+	filter *namespaceFilter
+}
+
+func (s filteredStore) List() []interface{} {
+	var result []interface{}
+	for _, obj := range s.objectStore.List() {
+		if m, err := meta.Accessor(obj); err == nil && s.filter.Matches(m.GetNamespace()) {
+			result = append(result, obj)
+		}
+	}
+	return result
+}
+
+func (s filteredStore) ListKeys() []string {
+	var result []string
+	for _, key := range s.objectStore.ListKeys() {
+		if namespace, _, err := cache.SplitMetaNamespaceKey(key); err == nil && s.filter.Matches(namespace) {
+			result = append(result, key)
+		}
+	}
+	return result
+}
+
+func (s filteredStore) GetByKey(key string) (interface{}, bool, error) {
+	namespace, _, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return nil, false, err
+	}
+	if !s.filter.Matches(namespace) {
+		return nil, false, nil
+	}
+	return s.objectStore.GetByKey(key)
+}
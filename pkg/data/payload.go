@@ -0,0 +1,138 @@
+// Copyright 2017 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package data
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+
+	"k8s.io/client-go/tools/cache"
+)
+
+// syncPayload is the document loaded into OPA on a full sync. Rather than
+// assembling the whole document as a map and encoding it into a buffer, it
+// keeps references to the objects in the informer store and streams them
+// into the request body when written.
+type syncPayload struct {
+	entries []payloadEntry
+	prepare prepareFunc
+}
+
+// prepareFunc returns the value to replicate for an object stored at key,
+// or false if the object must be left out.
+type prepareFunc func(key string, obj interface{}) (interface{}, bool)
+
+// payloadEntry is a single object in the payload, along with the path it
+// is stored at (e.g. [namespace, name] or [name]).
+type payloadEntry struct {
+	key  string
+	path []string
+	obj  interface{}
+}
+
+func generateSyncPayload(objs []interface{}, namespaced bool, prepare prepareFunc) (*syncPayload, error) {
+	entries := make([]payloadEntry, 0, len(objs))
+	for _, obj := range objs {
+		path, err := cache.MetaNamespaceKeyFunc(obj)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, payloadEntry{key: path, path: strings.Split(path, "/"), obj: obj})
+	}
+	return newSyncPayload(entries, prepare), nil
+}
+
+func newSyncPayload(entries []payloadEntry, prepare prepareFunc) *syncPayload {
+	// Sorting the entries groups objects sharing a parent (e.g. a namespace)
+	// together, so each parent object is opened and closed exactly once.
+	sort.Slice(entries, func(i, j int) bool {
+		return lessPath(entries[i].path, entries[j].path)
+	})
+
+	return &syncPayload{entries: entries, prepare: prepare}
+}
+
+// WriteJSON implements opa.JSONWriter
+func (p *syncPayload) WriteJSON(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	var open []string // parents of the previous entry, still open
+	var written bool
+	bw.WriteByte('{')
+	for _, entry := range p.entries {
+		// Objects are prepared one at a time, as they are written
+		value, ok := p.prepare(entry.key, entry.obj)
+		if !ok {
+			continue
+		}
+		dir, name := entry.path[:len(entry.path)-1], entry.path[len(entry.path)-1]
+		common := commonPrefix(open, dir)
+		for j := len(open); j > common; j-- {
+			bw.WriteByte('}')
+		}
+		if written {
+			bw.WriteByte(',')
+		}
+		for _, segment := range dir[common:] {
+			if err := writeKey(bw, segment); err != nil {
+				return err
+			}
+			bw.WriteByte('{')
+		}
+		open, written = dir, true
+		if err := writeKey(bw, name); err != nil {
+			return err
+		}
+		if err := enc.Encode(value); err != nil {
+			return err
+		}
+	}
+	for range open {
+		bw.WriteByte('}')
+	}
+	bw.WriteByte('}')
+	return bw.Flush()
+}
+
+// MarshalJSON implements json.Marshaler
+func (p *syncPayload) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := p.WriteJSON(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeKey(w *bufio.Writer, key string) error {
+	bs, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	w.Write(bs)
+	w.WriteByte(':')
+	return nil
+}
+
+func commonPrefix(a, b []string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+func lessPath(a, b []string) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
@@ -0,0 +1,373 @@
+// Copyright 2017 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Projection selects the parts of each object that are replicated into OPA.
+//
+// Paths are dot separated field names, e.g. `spec.replicas`. A `*` segment
+// matches every field of an object or every element of an array, and a
+// number matches a single array element. Field names containing dots can be
+// quoted with brackets, e.g.
+// `metadata.annotations["kubectl.kubernetes.io/last-applied-configuration"]`.
+type Projection struct {
+	include *pathTree // nil means the whole object is included
+	exclude *pathTree
+}
+
+// defaultProjection is applied when no projection is configured. The
+// managed fields are bookkeeping for server-side apply, and are of little
+// use to policies while taking a good share of each object's size.
+var defaultProjection = &Projection{
+	exclude: mustPathTree("metadata.managedFields"),
+}
+
+// NewProjection builds a Projection that replicates only the paths in
+// include (or the whole object if include is empty), minus the paths in
+// exclude. The managed fields are excluded unless exclude is set.
+func NewProjection(include, exclude []string) (*Projection, error) {
+	p := &Projection{exclude: defaultProjection.exclude}
+	var err error
+	if len(include) > 0 {
+		if p.include, err = newPathTree(include...); err != nil {
+			return nil, fmt.Errorf("invalid include path: %w", err)
+		}
+	}
+	if len(exclude) > 0 {
+		if p.exclude, err = newPathTree(exclude...); err != nil {
+			return nil, fmt.Errorf("invalid exclude path: %w", err)
+		}
+	}
+	return p, nil
+}
+
+// Apply returns the projection of the object. The object itself is never
+// modified, so it is safe to call on objects owned by an informer store.
+func (p *Projection) Apply(obj interface{}) interface{} {
+	if p == nil || (p.include == nil && p.exclude == nil) {
+		return obj
+	}
+	var value interface{}
+	switch o := obj.(type) {
+	case *unstructured.Unstructured:
+		value = o.Object
+	case map[string]interface{}:
+		value = o
+	default:
+		u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+		if err != nil {
+			return obj
+		}
+		value = u
+	}
+	if p.include != nil {
+		var ok bool
+		if value, ok = p.include.include(value); !ok {
+			value = map[string]interface{}{}
+		}
+	}
+	if p.exclude != nil {
+		value, _, _ = p.exclude.exclude(value)
+	}
+	return value
+}
+
+// pathTree is a set of field paths, stored as a prefix tree.
+type pathTree struct {
+	leaf     bool
+	children map[string]*pathTree
+	wildcard *pathTree
+}
+
+func newPathTree(paths ...string) (*pathTree, error) {
+	root := &pathTree{}
+	for _, path := range paths {
+		segments, err := parseFieldPath(path)
+		if err != nil {
+			return nil, err
+		}
+		root.add(segments)
+	}
+	return root, nil
+}
+
+func mustPathTree(paths ...string) *pathTree {
+	t, err := newPathTree(paths...)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func (t *pathTree) add(segments []pathSegment) {
+	node := t
+	for _, segment := range segments {
+		node = node.child(segment)
+	}
+	node.leaf = true
+}
+
+func (t *pathTree) child(segment pathSegment) *pathTree {
+	if segment.wildcard {
+		if t.wildcard == nil {
+			t.wildcard = &pathTree{}
+		}
+		return t.wildcard
+	}
+	if t.children == nil {
+		t.children = map[string]*pathTree{}
+	}
+	child, ok := t.children[segment.name]
+	if !ok {
+		child = &pathTree{}
+		t.children[segment.name] = child
+	}
+	return child
+}
+
+// matches returns the subtrees of t that apply to the given field.
+func (t *pathTree) matches(field string) []*pathTree {
+	var result []*pathTree
+	if child, ok := t.children[field]; ok {
+		result = append(result, child)
+	}
+	if t.wildcard != nil {
+		result = append(result, t.wildcard)
+	}
+	return result
+}
+
+// include returns the parts of value selected by the tree, and false if
+// nothing was selected.
+func (t *pathTree) include(value interface{}) (interface{}, bool) {
+	if t.leaf {
+		return value, true
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		var result map[string]interface{}
+		for field, item := range v {
+			projected, ok := t.includeField(field, item)
+			if !ok {
+				continue
+			}
+			if result == nil {
+				result = map[string]interface{}{}
+			}
+			result[field] = projected
+		}
+		return result, result != nil
+	case []interface{}:
+		// Elements that are not selected are kept as null, so the
+		// remaining ones keep their index.
+		result, found := make([]interface{}, len(v)), false
+		for i, item := range v {
+			if projected, ok := t.includeField(strconv.Itoa(i), item); ok {
+				result[i], found = projected, true
+			}
+		}
+		return result, found
+	}
+	return nil, false
+}
+
+func (t *pathTree) includeField(field string, value interface{}) (interface{}, bool) {
+	var result interface{}
+	var found bool
+	for _, m := range t.matches(field) {
+		projected, ok := m.include(value)
+		if !ok {
+			continue
+		}
+		if found {
+			result = mergeProjected(result, projected)
+		} else {
+			result, found = projected, true
+		}
+	}
+	return result, found
+}
+
+// mergeProjected merges two projections of the same value.
+func mergeProjected(a, b interface{}) interface{} {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			return a
+		}
+		result := make(map[string]interface{}, len(av)+len(bv))
+		for k, v := range av {
+			result[k] = v
+		}
+		for k, v := range bv {
+			if existing, ok := result[k]; ok {
+				result[k] = mergeProjected(existing, v)
+			} else {
+				result[k] = v
+			}
+		}
+		return result
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return a
+		}
+		result := make([]interface{}, len(av))
+		for i := range av {
+			result[i] = mergeProjected(av[i], bv[i])
+		}
+		return result
+	}
+	return a
+}
+
+// exclude returns value without the paths in the tree. It reports whether
+// value is kept at all, and whether anything was removed from it.
+// Containers are copied only when something is removed from them.
+func (t *pathTree) exclude(value interface{}) (interface{}, bool, bool) {
+	if t.leaf {
+		return nil, false, true
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		var result map[string]interface{}
+		for field, item := range v {
+			projected, keep, changed := t.excludeField(field, item)
+			if !changed {
+				continue
+			}
+			if result == nil {
+				result = make(map[string]interface{}, len(v))
+				for k, x := range v {
+					result[k] = x
+				}
+			}
+			if keep {
+				result[field] = projected
+			} else {
+				delete(result, field)
+			}
+		}
+		if result == nil {
+			return value, true, false
+		}
+		return result, true, true
+	case []interface{}:
+		var result []interface{}
+		for i, item := range v {
+			projected, keep, changed := t.excludeField(strconv.Itoa(i), item)
+			if changed && result == nil {
+				result = make([]interface{}, i, len(v))
+				copy(result, v[:i])
+			}
+			if result != nil && keep {
+				result = append(result, projected)
+			}
+		}
+		if result == nil {
+			return value, true, false
+		}
+		return result, true, true
+	}
+	return value, true, false
+}
+
+func (t *pathTree) excludeField(field string, value interface{}) (interface{}, bool, bool) {
+	result, changed := value, false
+	for _, m := range t.matches(field) {
+		projected, keep, removed := m.exclude(result)
+		if !keep {
+			return nil, false, true
+		}
+		result, changed = projected, changed || removed
+	}
+	return result, true, changed
+}
+
+// pathSegment is a single field name in a path, or a wildcard.
+type pathSegment struct {
+	name     string
+	wildcard bool
+}
+
+func parseFieldPath(path string) ([]pathSegment, error) {
+	var segments []pathSegment
+	expectField := true // a field name may follow (start of path or after '.')
+	for i := 0; i < len(path); {
+		switch c := path[i]; {
+		case c == '[':
+			end, segment, err := parseBracket(path, i)
+			if err != nil {
+				return nil, err
+			}
+			segments = append(segments, segment)
+			i, expectField = end, false
+		case c == '.':
+			if expectField {
+				return nil, fmt.Errorf("%q: empty field name at offset %d", path, i)
+			}
+			i, expectField = i+1, true
+		default:
+			if !expectField {
+				return nil, fmt.Errorf("%q: expected '.' or '[' at offset %d", path, i)
+			}
+			end := strings.IndexAny(path[i:], ".[")
+			if end < 0 {
+				end = len(path)
+			} else {
+				end += i
+			}
+			name := path[i:end]
+			segments = append(segments, pathSegment{name: name, wildcard: name == "*"})
+			i, expectField = end, false
+		}
+	}
+	if expectField {
+		return nil, fmt.Errorf("%q: path must not be empty or end with '.'", path)
+	}
+	return segments, nil
+}
+
+// parseBracket parses a `[...]` segment starting at path[start], which
+// holds a quoted field name, an array index or a `*` wildcard.
+func parseBracket(path string, start int) (int, pathSegment, error) {
+	rest := path[start+1:]
+	if strings.HasPrefix(rest, `"`) {
+		dec := json.NewDecoder(strings.NewReader(rest))
+		var name string
+		if err := dec.Decode(&name); err != nil {
+			return 0, pathSegment{}, fmt.Errorf("%q: invalid quoted field at offset %d: %w", path, start, err)
+		}
+		end := start + 1 + int(dec.InputOffset())
+		if end >= len(path) || path[end] != ']' {
+			return 0, pathSegment{}, fmt.Errorf("%q: missing ']' at offset %d", path, end)
+		}
+		return end + 1, pathSegment{name: name}, nil
+	}
+	end := strings.IndexByte(rest, ']')
+	if end < 0 {
+		return 0, pathSegment{}, fmt.Errorf("%q: missing ']' after offset %d", path, start)
+	}
+	inner := rest[:end]
+	switch {
+	case inner == "*" || inner == "_":
+		return start + end + 2, pathSegment{wildcard: true}, nil
+	case inner != "":
+		if _, err := strconv.Atoi(inner); err == nil {
+			return start + end + 2, pathSegment{name: inner}, nil
+		}
+	}
+	return 0, pathSegment{}, fmt.Errorf("%q: invalid index %q at offset %d", path, inner, start)
+}
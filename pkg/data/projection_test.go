@@ -0,0 +1,131 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/open-policy-agent/kube-mgmt/internal/expect"
+)
+
+func TestProjection(t *testing.T) {
+	t.Parallel()
+
+	obj := `{
+		"metadata": {
+			"name": "pod1",
+			"labels": {"app": "web"},
+			"annotations": {
+				"kubectl.kubernetes.io/last-applied-configuration": "{}",
+				"team": "a"
+			},
+			"managedFields": [{"manager": "kubectl"}]
+		},
+		"spec": {
+			"containers": [
+				{"name": "a", "image": "nginx", "args": ["x"]},
+				{"name": "b", "image": "redis"}
+			]
+		},
+		"status": {"phase": "Running"}
+	}`
+
+	tests := []struct {
+		name     string
+		include  []string
+		exclude  []string
+		expected string
+	}{
+		{
+			name:    "exclude",
+			exclude: []string{"metadata.managedFields", `metadata.annotations["kubectl.kubernetes.io/last-applied-configuration"]`, "status"},
+			expected: `{
+				"metadata": {
+					"name": "pod1",
+					"labels": {"app": "web"},
+					"annotations": {"team": "a"}
+				},
+				"spec": {
+					"containers": [
+						{"name": "a", "image": "nginx", "args": ["x"]},
+						{"name": "b", "image": "redis"}
+					]
+				}
+			}`,
+		},
+		{
+			name:    "include",
+			include: []string{"metadata.labels", "spec.containers[*].image", "spec.missing"},
+			expected: `{
+				"metadata": {"labels": {"app": "web"}},
+				"spec": {"containers": [{"image": "nginx"}, {"image": "redis"}]}
+			}`,
+		},
+		{
+			name:    "include overlapping wildcard",
+			include: []string{"spec.containers.*.image", "spec.containers.0.name"},
+			expected: `{
+				"spec": {"containers": [{"image": "nginx", "name": "a"}, {"image": "redis"}]}
+			}`,
+		},
+		{
+			name:    "include without exclude",
+			include: []string{"metadata.name", "metadata.managedFields"},
+			expected: `{
+				"metadata": {"name": "pod1"}
+			}`,
+		},
+		{
+			name:    "include and exclude",
+			include: []string{"metadata"},
+			exclude: []string{"metadata.managedFields", "metadata.annotations"},
+			expected: `{
+				"metadata": {"name": "pod1", "labels": {"app": "web"}}
+			}`,
+		},
+		{
+			name:    "exclude array element",
+			exclude: []string{"spec.containers[_].args", "spec.containers[1]"},
+			expected: `{
+				"metadata": {
+					"name": "pod1",
+					"labels": {"app": "web"},
+					"annotations": {
+						"kubectl.kubernetes.io/last-applied-configuration": "{}",
+						"team": "a"
+					},
+					"managedFields": [{"manager": "kubectl"}]
+				},
+				"spec": {"containers": [{"name": "a", "image": "nginx"}]},
+				"status": {"phase": "Running"}
+			}`,
+		},
+		{
+			name:     "include nothing",
+			include:  []string{"missing"},
+			expected: `{}`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := NewProjection(tc.include, tc.exclude)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			original := expect.MustUnmarshal(t, []byte(obj))
+			result := p.Apply(original)
+			expect.MustEqual(t, expect.MustRoundTrip(t, result), expect.MustRoundTrip(t, expect.MustUnmarshal(t, []byte(tc.expected))))
+			// The original object must not be modified
+			expect.MustEqual(t, expect.MustRoundTrip(t, original), expect.MustRoundTrip(t, expect.MustUnmarshal(t, []byte(obj))))
+		})
+	}
+}
+
+func TestProjectionInvalidPaths(t *testing.T) {
+	t.Parallel()
+
+	for _, path := range []string{"", ".a", "a.", "a..b", `a["b"`, "a[b]", "a[]", `a["b"]c`} {
+		if _, err := NewProjection([]string{path}, nil); err == nil {
+			t.Errorf("Expected error for path %q", path)
+		}
+	}
+}
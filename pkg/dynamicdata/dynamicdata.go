@@ -3,10 +3,14 @@ package dynamicdata
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/open-policy-agent/kube-mgmt/pkg/data"
 	"github.com/open-policy-agent/kube-mgmt/pkg/opa"
@@ -40,66 +44,196 @@ import (
 	"k8s.io/client-go/rest"
 )
 
+const (
+	// discoveryInterval is how often resource types are discovered again,
+	// e.g. to pick up CustomResourceDefinitions installed since.
+	discoveryInterval = 5 * time.Minute
+	// unresolvedInterval is how often resource types are discovered again
+	// while the analysis refers to resources that cannot be resolved.
+	unresolvedInterval = 30 * time.Second
+	// stopTimeout bounds how long the analyzer takes to shut down.
+	stopTimeout = 10 * time.Second
+)
+
 type Sync struct {
-	opaConfig          []byte
-	kubeconfig         *rest.Config
-	opaURL, opaAuth    string
-	ignoreNs           []string
-	analysisEntrypoint string
-	replicatePath      string
-	logger             logging.Logger
-	running            map[types.ResourceType]*cancellableSync
-	mu                 sync.Mutex
-	ready              bool
+	opaConfig           []byte
+	policyDir           string
+	kubeconfig          *rest.Config
+	target              opa.Data // the replicate path
+	replicatePath       string
+	analysisEntrypoints []string
+	logger              logging.Logger
+	running             map[ref]*cancellableSync
+	previous            map[ref]<-chan struct{} // closed once the last sync of a ref has stopped
+	linger              time.Duration
+	removeData          bool
+	static              map[string]struct{} // resources replicated statically
+	clusters            []string            // remote clusters replicated into the replicate path
+	cleanup             func(ctx context.Context, keep []string)
+	rts                 *resourceTypes
+	policies            *policyModules
+	discover            func() (*resourceTypes, error)
+	opts                []data.Option
+	mu                  sync.Mutex
+	ready               bool
+	analyzer            *analyzer
+	refs                []RefStatus    // of the last analysis result
+	syncs               sync.WaitGroup // running GenericSyncs and policy watcher
+	done                chan struct{}
 }
 
-func New(configFile string, analysisEntrypoint string, opaURL, opaAuth string, ignoreNs []string, replicatePath string, kubeconfig *rest.Config, logger logging.Logger) (*Sync, error) {
+// New returns a new Sync that can be started. The policies to analyze are
+// downloaded from the bundles of the OPA configuration file, and loaded
+// from the .rego files of the policy directory; either may be empty. The
+// options are applied to every data.GenericSync it starts.
+func New(configFile, policyDir string, analysisEntrypoints []string, opaURL, opaAuth string, ignoreNs []string, replicatePath string, kubeconfig *rest.Config, logger logging.Logger, opts ...data.Option) (*Sync, error) {
 
-	bs, err := os.ReadFile(configFile)
-	if err != nil {
-		return nil, err
+	if configFile == "" && policyDir == "" {
+		return nil, fmt.Errorf("either an OPA configuration file or a policy directory is required")
+	}
+
+	var bs []byte
+	if configFile != "" {
+		var err error
+		if bs, err = os.ReadFile(configFile); err != nil {
+			return nil, err
+		}
 	}
 
 	sync := &Sync{
-		opaConfig:          bs,
-		kubeconfig:         kubeconfig,
-		opaAuth:            opaAuth,
-		opaURL:             opaURL,
-		ignoreNs:           ignoreNs,
-		analysisEntrypoint: analysisEntrypoint,
-		replicatePath:      replicatePath,
-		logger:             logger,
-		running:            make(map[types.ResourceType]*cancellableSync),
+		opaConfig:           bs,
+		policyDir:           policyDir,
+		kubeconfig:          kubeconfig,
+		target:              opa.New(opaURL, opaAuth).Prefix(replicatePath),
+		replicatePath:       replicatePath,
+		analysisEntrypoints: analysisEntrypoints,
+		logger:              logger,
+		running:             make(map[ref]*cancellableSync),
+		previous:            make(map[ref]<-chan struct{}),
+		policies:            newPolicyModules(),
+		done:                make(chan struct{}),
+		opts:                append([]data.Option{data.WithIgnoreNamespaces(ignoreNs)}, opts...),
+		discover: func() (*resourceTypes, error) {
+			return resolveResourceTypes(kubeconfig)
+		},
 	}
 
 	return sync, nil
 }
 
+// Run starts the analyzer and replicates the resources it finds until the
+// context is cancelled. Done is closed once everything has stopped, or
+// right away if Run fails.
 func (s *Sync) Run(ctx context.Context) error {
 
 	s.logger.Debug("Loading kubeconfig for API server")
 	client, err := dynamic.NewForConfig(s.kubeconfig)
 	if err != nil {
+		close(s.done)
 		return err
 	}
 
 	s.logger.Debug("Resolving resource names to resource types")
-	rts, err := resolveResourceTypes(s.kubeconfig)
+	rts, err := s.discover()
 	if err != nil {
+		close(s.done)
 		return err
 	}
+	s.rts = rts
+
+	var dir *policyDir
+	if s.policyDir != "" {
+		s.logger.Debug("Loading policies from %v", s.policyDir)
+		dir, err = newPolicyDir(s.policyDir, s.policies)
+		if err != nil {
+			close(s.done)
+			return err
+		}
+	}
 
 	s.logger.Debug("Starting analyzer")
-	analyzer, err := newAnalyzer(ctx, s.opaConfig, s.replicatePath, s.analysisEntrypoint, s.logger)
+	analyzer, err := newAnalyzer(ctx, s.opaConfig, s.replicatePath, s.analysisEntrypoints, s.clusters, s.policies, s.logger)
 	if err != nil {
+		if dir != nil {
+			dir.watcher.Close()
+		}
+		close(s.done)
 		return err
 	}
 
-	go s.loop(ctx, analyzer, rts, client)
+	if dir != nil {
+		s.syncs.Add(1)
+		go func() {
+			defer s.syncs.Done()
+			dir.run(ctx)
+		}()
+	}
+
+	s.mu.Lock()
+	s.analyzer = analyzer
+	s.mu.Unlock()
+
+	go s.loop(ctx, analyzer, client)
 
 	return nil
 }
 
+// SetLinger sets how long resources keep being replicated once the policies
+// no longer refer to them. By default, replication stops right away. Must
+// be called before Run.
+func (s *Sync) SetLinger(linger time.Duration) {
+	s.linger = linger
+}
+
+// SetRemoveData sets whether the data of resources is removed from OPA
+// once their replication stops. By default, the data is left behind. Must
+// be called before Run.
+func (s *Sync) SetRemoveData(removeData bool) {
+	s.removeData = removeData
+}
+
+// SetStatic sets the resources replicated statically, e.g. with the
+// --replicate flags, into the replicate path. They are not replicated
+// dynamically, so that the objects replicated with their own options are
+// not overwritten. Must be called before Run.
+func (s *Sync) SetStatic(resources []string) {
+	s.static = make(map[string]struct{}, len(resources))
+	for _, resource := range resources {
+		s.static[resource] = struct{}{}
+	}
+}
+
+// SetClusters sets the names of the remote clusters replicated into the
+// replicate path, next to the resources. Policies referring to their data
+// are not analyzed for resources to replicate. Must be called before Run.
+func (s *Sync) SetClusters(names []string) {
+	s.clusters = names
+}
+
+// SetCleanup sets a function called once, after the first analysis result
+// has been processed, with the documents under the replicate path that the
+// resources replicated dynamically are written into, e.g. to remove stale
+// data while keeping these. Must be called before Run.
+func (s *Sync) SetCleanup(cleanup func(ctx context.Context, keep []string)) {
+	s.cleanup = cleanup
+}
+
+// Done returns a channel closed once the Sync has stopped.
+func (s *Sync) Done() <-chan struct{} {
+	return s.done
+}
+
+// Wait blocks until the Sync has stopped.
+func (s *Sync) Wait() {
+	<-s.done
+}
+
+// Policies returns a client loading policies into OPA through the given
+// client, so that the policies are analyzed along with the bundles.
+func (s *Sync) Policies(client opa.Client) opa.Client {
+	return &policyRecorder{Client: client, modules: s.policies}
+}
+
 func (s *Sync) Ready() bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -107,80 +241,330 @@ func (s *Sync) Ready() bool {
 		s.logger.Debug("Sync is not ready")
 		return false
 	}
-	for rt, r := range s.running {
+	for ref, r := range s.running {
 		if !r.sync.Ready() {
-			s.logger.Debug("Replicator for %v is not ready", rt)
+			s.logger.Debug("Replicator for %v is not ready", ref)
 			return false
 		}
 	}
 	return true
 }
 
-func (s *Sync) loop(ctx context.Context, a *analyzer, rts map[string]types.ResourceType, client *dynamic.DynamicClient) {
+func (s *Sync) loop(ctx context.Context, a *analyzer, client dynamic.Interface) {
+	var last *analysisResult
+	var retry <-chan time.Time  // set while some resources are unresolved
+	var expire <-chan time.Time // set while some replications linger
+	ticker := time.NewTicker(discoveryInterval)
+	defer ticker.Stop()
 	for {
 		s.logger.Debug("Sync waiting for analysis result")
 		select {
 		case result := <-a.C:
 			s.logger.Debug("Sync processing analysis result: %v", result)
-			s.processAnalysisResult(ctx, result, rts, client)
+			last = &result
+			retry = s.retry(s.process(ctx, result, client))
+			expire = s.expire(time.Now())
+		case <-ticker.C:
+			s.refresh()
+			if last != nil {
+				retry = s.retry(s.processAnalysisResult(ctx, *last, s.rts, client))
+				expire = s.expire(time.Now())
+			}
+		case <-retry:
+			retry = s.retry(s.process(ctx, *last, client))
+			expire = s.expire(time.Now())
+		case now := <-expire:
+			expire = s.expire(now)
 		case <-ctx.Done():
 			s.logger.Debug("Sync shutting down")
+			s.stop(a)
+			return
+		}
+		// Clean up once the resources first referred to have been resolved
+		if s.cleanup != nil && last != nil && retry == nil {
+			s.cleanup(ctx, s.replicating())
+			s.cleanup = nil
 		}
 	}
 }
 
-func (s *Sync) processAnalysisResult(ctx context.Context, result analysisResult, rts map[string]types.ResourceType, client *dynamic.DynamicClient) {
+// replicating returns the documents under the replicate path that the
+// running replications are written into.
+func (s *Sync) replicating() []string {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.running))
+	for ref := range s.running {
+		if ref.Group != "" {
+			keys = append(keys, ref.Group)
+		} else {
+			keys = append(keys, ref.Resource)
+		}
+	}
+	return keys
+}
 
-	// If any of the refs cannot be mapped to gvk then give up.
+// stop stops the analyzer and the replications, then closes done.
+func (s *Sync) stop(a *analyzer) {
+	defer close(s.done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	if err := a.Stop(ctx); err != nil {
+		logrus.Errorf("Failed to stop analyzer: %v", err)
+	}
+
+	s.mu.Lock()
+	s.ready = false
+	for ref, r := range s.running {
+		s.logger.Debug("Stopping replication for %v", r.rt)
+		r.cancel()
+		delete(s.running, ref)
+	}
+	s.mu.Unlock()
+
+	s.syncs.Wait()
+	s.logger.Debug("Sync stopped")
+}
+
+// retry returns a channel firing when unresolved resources must be
+// looked up again, or nil if all resources were resolved.
+func (s *Sync) retry(resolved bool) <-chan time.Time {
+	if resolved {
+		return nil
+	}
+	return time.After(unresolvedInterval)
+}
+
+// process handles the analysis result, discovering resource types again
+// first if the result refers to unknown resources. It returns false if
+// some resources still cannot be resolved.
+func (s *Sync) process(ctx context.Context, result analysisResult, client dynamic.Interface) bool {
 	for _, ref := range result.Refs {
-		if _, ok := rts[ref.Resource]; !ok {
-			logrus.Errorf("Cannot resolve Kubernetes resource %q to group/version/resource for dynamic data replication", ref.Resource)
-			s.ready = false
-			return
+		if _, err := s.rts.resolve(ref); err != nil {
+			s.logger.Debug("Resource %v is unresolved, discovering resource types again: %v", ref, err)
+			s.refresh()
+			break
+		}
+	}
+	return s.processAnalysisResult(ctx, result, s.rts, client)
+}
+
+// refresh discovers resource types again, keeping the previous ones on error.
+func (s *Sync) refresh() {
+	rts, err := s.discover()
+	if err != nil {
+		logrus.Errorf("Failed to discover resource types for dynamic data replication: %v", err)
+		return
+	}
+	s.rts = rts
+}
+
+func (s *Sync) processAnalysisResult(ctx context.Context, result analysisResult, rts *resourceTypes, client dynamic.Interface) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resolved := make(map[ref]types.ResourceType, len(result.Refs))
+	unresolved := 0
+	s.refs = make([]RefStatus, 0, len(result.Refs))
+	for _, ref := range result.Refs {
+		status := RefStatus{Ref: ref.String()}
+		if _, ok := s.static[ref.Resource]; ok && ref.Group == "" {
+			s.logger.Debug("Resource %v is replicated statically", ref)
+			status.Static = true
+		} else if rt, err := rts.resolve(ref); err != nil {
+			logrus.Errorf("Cannot resolve Kubernetes resource %v to group/version/resource for dynamic data replication: %v", ref, err)
+			status.Error = err.Error()
+			unresolved++
+		} else {
+			resolved[ref] = rt
+			status.ResourceType, status.Namespaced = rt.String(), rt.Namespaced
+			status.Fields = fieldPaths(rt, result.Fields[ref])
 		}
+		s.refs = append(s.refs, status)
+	}
+
+	// If any of the refs cannot be mapped to gvk then give up.
+	if unresolved > 0 {
+		s.ready = false
+		return false
 	}
 
 	// Otherwise, create and delete data syncs accordingly.
 	s.ready = true
-	create := map[types.ResourceType]struct{}{}
 
-	for _, ref := range result.Refs {
-		rt := rts[ref.Resource]
-		create[rt] = struct{}{}
-		if _, ok := s.running[rt]; !ok {
-			s.logger.Debug("Starting data replication for %v", rt)
-			sync := data.NewFromInterface(client, opa.New(s.opaURL, s.opaAuth).Prefix(s.replicatePath), rt, data.WithIgnoreNamespaces(s.ignoreNs))
-			ctx, cancel := context.WithCancel(ctx)
-			s.running[rt] = &cancellableSync{cancel: cancel, sync: sync}
-			go sync.RunContext(ctx)
+	for i, ref := range result.Refs {
+		rt, ok := resolved[ref]
+		if !ok { // replicated statically
+			continue
+		}
+		paths := s.refs[i].Fields
+		projection, err := fieldProjection(paths)
+		if err != nil {
+			logrus.Warnf("Replicating whole objects of %v, cannot project fields %v: %v", rt, paths, err)
+			paths, projection = nil, nil
+			s.refs[i].Fields = nil
+		}
+		fields := strings.Join(paths, ",")
+		if r, ok := s.running[ref]; ok {
+			if r.rt == rt && r.fields == fields {
+				s.logger.Debug("Data replication for %v already started", rt)
+				continue
+			}
+			s.logger.Debug("Stopping replication for %v, %v now resolves to %v (fields: %v)", r.rt, ref, rt, paths)
+			r.cancel()
+		}
+		opts := s.opts
+		if projection != nil {
+			s.logger.Debug("Starting data replication for %v, fields: %v", rt, paths)
+			opts = append(opts[:len(opts):len(opts)], data.WithProjection(projection))
 		} else {
-			s.logger.Debug("Data replication for %v already started", rt)
+			s.logger.Debug("Starting data replication for %v", rt)
 		}
+		target := s.target
+		if ref.Group != "" {
+			target = target.Prefix(ref.Group)
+		}
+		sync := data.NewFromInterface(client, target, rt, opts...)
+		ctx, cancel := context.WithCancel(ctx)
+		r := &cancellableSync{cancel: cancel, sync: sync, rt: rt, fields: fields, paths: paths, stopped: make(chan struct{})}
+		previous := s.previous[ref]
+		s.running[ref], s.previous[ref] = r, r.stopped
+		s.syncs.Add(1)
+		go func() {
+			defer s.syncs.Done()
+			defer close(r.stopped)
+			// Wait for the previous sync to stop writing into, or removing,
+			// the same path.
+			if previous != nil {
+				<-previous
+			}
+			if err := sync.RunContext(ctx); err != nil && ctx.Err() == nil {
+				logrus.Errorf("Replication for %v failed: %v", rt, err)
+			}
+			if r.remove.Load() {
+				s.logger.Debug("Removing replicated data of %v", rt)
+				if err := target.PatchData(rt.Resource, "remove", nil); err != nil && !opa.IsNotFoundErr(err) {
+					logrus.Errorf("Failed to remove replicated data of %v: %v", rt, err)
+				}
+			}
+		}()
 	}
 
-	for rt, sync := range s.running {
-		if _, ok := create[rt]; !ok {
-			s.logger.Debug("Stopping replication for %v", rt)
-			sync.cancel()
-			delete(s.running, rt)
+	// Replications no longer needed linger for a while, in case they are
+	// needed again shortly, e.g. while bundles are being rolled out.
+	for ref, r := range s.running {
+		if _, ok := resolved[ref]; ok {
+			r.stopAt = time.Time{}
+			continue
+		}
+		if s.linger <= 0 {
+			s.stopReplication(ref, r)
+		} else if r.stopAt.IsZero() {
+			r.stopAt = time.Now().Add(s.linger)
+			s.logger.Debug("Replication for %v is no longer needed, stopping at %v", r.rt, r.stopAt)
 		}
 	}
+	return true
 }
 
-func resolveResourceTypes(config *rest.Config) (map[string]types.ResourceType, error) {
+// stopReplication stops the replication for the ref, removing its data if
+// configured to. Must be called with the lock held.
+func (s *Sync) stopReplication(ref ref, r *cancellableSync) {
+	s.logger.Debug("Stopping replication for %v", r.rt)
+	r.remove.Store(s.removeData)
+	r.cancel()
+	delete(s.running, ref)
+}
+
+// expire stops the replications that have lingered long enough, and
+// returns a channel firing when the next one should be stopped, or nil.
+func (s *Sync) expire(now time.Time) <-chan time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var next time.Time
+	for ref, r := range s.running {
+		switch {
+		case r.stopAt.IsZero():
+		case !now.Before(r.stopAt):
+			s.stopReplication(ref, r)
+		case next.IsZero() || r.stopAt.Before(next):
+			next = r.stopAt
+		}
+	}
+	if next.IsZero() {
+		return nil
+	}
+	return time.After(next.Sub(now))
+}
+
+// resourceTypes maps the names of resources to their types, by API group.
+type resourceTypes struct {
+	groups map[string]map[string]types.ResourceType
+}
+
+func newResourceTypes(rts ...types.ResourceType) *resourceTypes {
+	result := &resourceTypes{groups: map[string]map[string]types.ResourceType{}}
+	for _, rt := range rts {
+		result.add(rt)
+	}
+	return result
+}
+
+func (r *resourceTypes) add(rt types.ResourceType) {
+	if r.groups[rt.Group] == nil {
+		r.groups[rt.Group] = map[string]types.ResourceType{}
+	}
+	r.groups[rt.Group][rt.Resource] = rt
+}
+
+// resolve returns the type of the referenced resource. Resources that are
+// not qualified by a group are looked up in the core group first, then in
+// all other groups, and are reported as ambiguous if several groups define
+// them.
+func (r *resourceTypes) resolve(ref ref) (types.ResourceType, error) {
+	if rt, ok := r.groups[ref.Group][ref.Resource]; ok {
+		return rt, nil
+	}
+	if ref.Group != "" {
+		return types.ResourceType{}, fmt.Errorf("resource %q not found in group %q", ref.Resource, ref.Group)
+	}
+	var found []types.ResourceType
+	for _, resources := range r.groups {
+		if rt, ok := resources[ref.Resource]; ok {
+			found = append(found, rt)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return types.ResourceType{}, fmt.Errorf("resource %q not found", ref.Resource)
+	case 1:
+		return found[0], nil
+	}
+	groups := make([]string, 0, len(found))
+	for _, rt := range found {
+		groups = append(groups, rt.Group)
+	}
+	sort.Strings(groups)
+	return types.ResourceType{}, fmt.Errorf("resource %q is ambiguous, found in groups %v: qualify it with its group, e.g. [%q].%v", ref.Resource, groups, groups[0], ref.Resource)
+}
+
+func resolveResourceTypes(config *rest.Config) (*resourceTypes, error) {
 	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create discovery client: %v", err)
 	}
 
+	// Use the resources discovered even if some API groups are unavailable,
+	// e.g. an aggregated API whose backend is down.
 	resources, err := discoveryClient.ServerPreferredResources()
-	if err != nil {
+	if discovery.IsGroupDiscoveryFailedError(err) {
+		logrus.Warnf("Failed to discover some resources for dynamic data replication: %v", err)
+	} else if err != nil {
 		return nil, fmt.Errorf("failed to get server preferred resources: %v", err)
 	}
 
-	result := map[string]types.ResourceType{}
+	result := newResourceTypes()
 
 	for _, r := range resources {
 		gv, err := schema.ParseGroupVersion(r.GroupVersion)
@@ -188,6 +572,9 @@ func resolveResourceTypes(config *rest.Config) (map[string]types.ResourceType, e
 			return nil, err
 		}
 		for _, ar := range r.APIResources {
+			if strings.Contains(ar.Name, "/") { // subresources, e.g. pods/log
+				continue
+			}
 			rt := types.ResourceType{
 				Namespaced: ar.Namespaced,
 				Resource:   ar.Name,
@@ -200,8 +587,8 @@ func resolveResourceTypes(config *rest.Config) (map[string]types.ResourceType, e
 			if rt.Version == "" {
 				rt.Version = gv.Version
 			}
-			logrus.Infof("Discovered resource %v mapping to type %v (namespaced: %v)", ar.Name, rt, rt.Namespaced)
-			result[ar.Name] = rt
+			logrus.Debugf("Discovered resource %v mapping to type %v (namespaced: %v)", ar.Name, rt, rt.Namespaced)
+			result.add(rt)
 		}
 	}
 
@@ -209,29 +596,50 @@ func resolveResourceTypes(config *rest.Config) (map[string]types.ResourceType, e
 }
 
 type cancellableSync struct {
-	cancel context.CancelFunc
-	sync   *data.GenericSync
+	cancel  context.CancelFunc
+	sync    *data.GenericSync
+	rt      types.ResourceType
+	fields  string
+	paths   []string
+	stopAt  time.Time     // when to stop lingering, if no longer needed
+	remove  atomic.Bool   // whether to remove the data once stopped
+	stopped chan struct{} // closed once stopped
 }
 
 type analyzer struct {
-	C       chan analysisResult
-	updates chan *ast.Compiler
-	opa     *sdk.OPA
-	prefix  ast.Ref
-	entry   ast.Ref
-	logger  logging.Logger
+	C        chan analysisResult
+	updates  chan *ast.Compiler
+	policies *policyModules
+	opa      *sdk.OPA
+	prefix   ast.Ref
+	entries  []ast.Ref
+	exclude  map[string]struct{} // documents under the prefix other than resources
+	logger   logging.Logger
+	cancel   context.CancelFunc
+	done     chan struct{} // closed once loop has returned
+	mu       sync.Mutex
+	st       analyzerStatus
 }
 
 type analysisResult struct {
 	Refs []ref
+	// Fields holds, for each resource, the refs the policies make to it
+	// relative to the resource, e.g. [ns][name].metadata.labels for pods.
+	Fields map[ref][]ast.Ref
 }
 
-func newAnalyzer(ctx context.Context, bs []byte, replicatePath, analysisEntrypoint string, logger logging.Logger) (*analyzer, error) {
+func newAnalyzer(ctx context.Context, bs []byte, replicatePath string, analysisEntrypoints []string, clusters []string, policies *policyModules, logger logging.Logger) (*analyzer, error) {
 
 	a := &analyzer{
-		C:       make(chan analysisResult),
-		updates: make(chan *ast.Compiler, 1),
-		logger:  logger,
+		C:        make(chan analysisResult),
+		updates:  make(chan *ast.Compiler, 1),
+		policies: policies,
+		exclude:  make(map[string]struct{}, len(clusters)),
+		logger:   logger,
+		done:     make(chan struct{}),
+	}
+	for _, name := range clusters {
+		a.exclude[name] = struct{}{}
 	}
 
 	var err error
@@ -240,13 +648,22 @@ func newAnalyzer(ctx context.Context, bs []byte, replicatePath, analysisEntrypoi
 	if err != nil {
 		return nil, err
 	}
-	a.entry, err = ast.PtrRef(ast.DefaultRootDocument, analysisEntrypoint)
-	if err != nil {
-		return nil, err
+	for _, entrypoint := range analysisEntrypoints {
+		entry, err := ast.PtrRef(ast.DefaultRootDocument, entrypoint)
+		if err != nil {
+			return nil, err
+		}
+		a.entries = append(a.entries, entry)
 	}
 
+	ctx, a.cancel = context.WithCancel(ctx)
 	go a.loop(ctx)
 
+	// Without an OPA configuration only the policies are analyzed
+	if bs == nil {
+		return a, nil
+	}
+
 	store := inmem.New()
 
 	err = storage.Txn(ctx, store, storage.TransactionParams{Write: true}, func(txn storage.Transaction) error {
@@ -254,24 +671,58 @@ func newAnalyzer(ctx context.Context, bs []byte, replicatePath, analysisEntrypoi
 		return err
 	})
 	if err != nil {
+		a.cancel()
 		return nil, err
 	}
 
 	a.opa, err = sdk.New(ctx, sdk.Options{Config: bytes.NewBuffer(bs), Store: store, Logger: logger})
 	if err != nil {
+		a.cancel()
 		return nil, err
 	}
 
 	return a, nil
 }
 
+// ref is a reference to replicated resources, e.g. data.kubernetes.pods,
+// or data.kubernetes["networking.k8s.io"].ingresses when qualified by an
+// API group.
 type ref struct {
+	Group    string
 	Resource string
 }
 
+func (r ref) String() string {
+	if r.Group == "" {
+		return r.Resource
+	}
+	return fmt.Sprintf("[%q].%v", r.Group, r.Resource)
+}
+
+// record updates the status after an analysis
+func (a *analyzer) record(err error, missing []ast.Ref) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.st.lastAnalysis, a.st.err, a.st.missing = time.Now(), err, nil
+	for _, entry := range missing {
+		a.st.missing = append(a.st.missing, entry.String())
+	}
+}
+
+func (a *analyzer) status() analyzerStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.st
+}
+
+// Stop stops the analysis and the embedded OPA, then closes C.
 func (a *analyzer) Stop(ctx context.Context) error {
+	a.cancel()
+	<-a.done
+	if a.opa != nil {
+		a.opa.Stop(ctx)
+	}
 	close(a.C)
-	a.opa.Stop(ctx)
 	return nil
 }
 
@@ -281,23 +732,51 @@ func (a *analyzer) trigger(_ context.Context, txn storage.Transaction, event sto
 	if compiler == nil {
 		return
 	}
-	a.updates <- compiler
+	a.mu.Lock()
+	a.st.lastTrigger = time.Now()
+	a.mu.Unlock()
+	select {
+	case a.updates <- compiler:
+	case <-a.done:
+	}
 }
 
 func (a *analyzer) loop(ctx context.Context) {
+	defer close(a.done)
+	var bundles *ast.Compiler
 	for {
 		select {
-		case compiler := <-a.updates:
-			refs, missing, err := analyzeRefs(compiler, []ast.Ref{a.entry}, a.prefix, a.logger)
-			if err != nil {
-				a.logger.Error("Failed to analyze refs: %v", err)
-				continue
-			}
-			if len(missing) > 0 {
-				a.logger.Debug("Analysis could not find entrypoints %v, skipping update", missing)
-				continue
+		case bundles = <-a.updates:
+		case <-a.policies.changed:
+		case <-ctx.Done():
+			logrus.Info("Analyzer shutting down")
+			return
+		}
+		compiler, err := a.policies.compile(bundles)
+		if err != nil {
+			a.logger.Error("Failed to compile policies for analysis: %v", err)
+			a.record(err, nil)
+			continue
+		}
+		if compiler == nil {
+			continue
+		}
+		result, missing, err := analyzeRefs(compiler, a.entries, a.prefix, a.exclude, a.logger)
+		if err != nil {
+			a.logger.Error("Failed to analyze refs: %v", err)
+			a.record(err, nil)
+			continue
+		}
+		a.record(nil, missing)
+		if len(missing) > 0 {
+			for _, entry := range missing {
+				a.logger.Warn("Analysis could not find rules for entrypoint %v", entry)
 			}
-			a.C <- analysisResult{Refs: refs}
+			a.logger.Warn("Skipping update, %d of %d entrypoints are missing", len(missing), len(a.entries))
+			continue
+		}
+		select {
+		case a.C <- result:
 		case <-ctx.Done():
 			logrus.Info("Analyzer shutting down")
 			return
@@ -305,9 +784,9 @@ func (a *analyzer) loop(ctx context.Context) {
 	}
 }
 
-func analyzeRefs(c *ast.Compiler, entrypoints []ast.Ref, prefix ast.Ref, logger logging.Logger) ([]ref, []ast.Ref, error) {
+func analyzeRefs(c *ast.Compiler, entrypoints []ast.Ref, prefix ast.Ref, exclude map[string]struct{}, logger logging.Logger) (analysisResult, []ast.Ref, error) {
 	logger.Debug("Analyzing dependencies for references to %v starting from %v", prefix, entrypoints)
-	resultMap := map[string]struct{}{}
+	resultMap := map[ref][]ast.Ref{}
 	visited := map[*ast.Rule]struct{}{}
 	var queue []*ast.Rule
 
@@ -321,7 +800,7 @@ func analyzeRefs(c *ast.Compiler, entrypoints []ast.Ref, prefix ast.Ref, logger
 		queue = append(queue, rules...)
 	}
 	if len(missing) > 0 {
-		return nil, missing, nil
+		return analysisResult{}, missing, nil
 	}
 
 	for len(queue) > 0 {
@@ -340,23 +819,107 @@ func analyzeRefs(c *ast.Compiler, entrypoints []ast.Ref, prefix ast.Ref, logger
 			continue
 		}
 		logrus.Debugf("Analyzed %v and found %v", next.Location, deps)
-		for _, ref := range deps {
-			if ref.HasPrefix(prefix) && len(ref) > len(prefix) {
-				if s, ok := ref[len(prefix)].Value.(ast.String); ok {
-					resultMap[string(s)] = struct{}{}
-				}
+		for _, dep := range deps {
+			if r, fields, ok := resourceRef(dep, prefix, exclude); ok {
+				resultMap[r] = append(resultMap[r], fields)
 			}
 		}
 	}
 
-	var result []ref
+	result := analysisResult{Fields: resultMap}
 	for x := range resultMap {
-		result = append(result, ref{Resource: x})
+		result.Refs = append(result.Refs, x)
 	}
 
-	sort.Slice(result, func(i, j int) bool {
-		return result[i].Resource < result[j].Resource
+	sort.Slice(result.Refs, func(i, j int) bool {
+		if result.Refs[i].Group != result.Refs[j].Group {
+			return result.Refs[i].Group < result.Refs[j].Group
+		}
+		return result.Refs[i].Resource < result.Refs[j].Resource
 	})
 
 	return result, nil, nil
 }
+
+// resourceRef returns the resource referred to by a ref under the prefix,
+// along with the rest of the ref. A segment containing a dot is an API
+// group, qualifying the resource in the next segment. Indexes and the
+// excluded documents, e.g. those of remote clusters, are not resources.
+func resourceRef(dep, prefix ast.Ref, exclude map[string]struct{}) (ref, ast.Ref, bool) {
+	if !dep.HasPrefix(prefix) || len(dep) <= len(prefix) {
+		return ref{}, nil, false
+	}
+	s, ok := dep[len(prefix)].Value.(ast.String)
+	if !ok || string(s) == data.IndexPath {
+		return ref{}, nil, false
+	}
+	if _, excluded := exclude[string(s)]; excluded {
+		return ref{}, nil, false
+	}
+	if !strings.Contains(string(s), ".") {
+		return ref{Resource: string(s)}, dep[len(prefix)+1:], true
+	}
+	if len(dep) <= len(prefix)+1 {
+		return ref{}, nil, false
+	}
+	resource, ok := dep[len(prefix)+1].Value.(ast.String)
+	if !ok {
+		return ref{}, nil, false
+	}
+	return ref{Group: string(s), Resource: string(resource)}, dep[len(prefix)+2:], true
+}
+
+// fieldPaths returns the projection paths of the fields read from objects
+// of the resource, or nil if whole objects are read, e.g. when an object
+// is passed to a function, or when the refs cannot be analyzed.
+func fieldPaths(rt types.ResourceType, refs []ast.Ref) []string {
+	// Objects are stored at [namespace][name], or [name] if cluster-scoped
+	depth := 1
+	if rt.Namespaced {
+		depth = 2
+	}
+	seen := map[string]struct{}{}
+	for _, r := range refs {
+		if len(r) <= depth {
+			return nil
+		}
+		seen[fieldPath(r[depth:])] = struct{}{}
+	}
+	paths := make([]string, 0, len(seen))
+	for path := range seen {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// fieldPath returns the projection path for the terms of a ref. Terms that
+// are not constant, e.g. variables, match every field or element.
+func fieldPath(terms ast.Ref) string {
+	var b strings.Builder
+	for _, term := range terms {
+		switch v := term.Value.(type) {
+		case ast.String:
+			bs, _ := json.Marshal(string(v))
+			fmt.Fprintf(&b, "[%s]", bs)
+		case ast.Number:
+			if n, ok := v.Int(); ok && n >= 0 {
+				fmt.Fprintf(&b, "[%d]", n)
+				continue
+			}
+			b.WriteString("[*]")
+		default:
+			b.WriteString("[*]")
+		}
+	}
+	return b.String()
+}
+
+// fieldProjection returns the projection replicating only the fields read
+// by the policies, or nil to replicate whole objects.
+func fieldProjection(paths []string) (*data.Projection, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	return data.NewProjection(paths, []string{"metadata.managedFields"})
+}
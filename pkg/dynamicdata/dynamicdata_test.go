@@ -2,13 +2,32 @@ package dynamicdata
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
+
+	"github.com/open-policy-agent/kube-mgmt/internal/expect"
+	"github.com/open-policy-agent/kube-mgmt/pkg/opa"
+	"github.com/open-policy-agent/kube-mgmt/pkg/types"
+
+	//lint:ignore SA1019 using OPA v0.x to ensure backwards compatible with pre-1.0 bundles
+	"github.com/open-policy-agent/opa/ast"
 
 	//lint:ignore SA1019 using OPA v0.x to ensure backwards compatible with pre-1.0 bundles
 	sdktest "github.com/open-policy-agent/opa/sdk/test"
 
 	"github.com/open-policy-agent/opa/v1/logging"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
 )
 
 func TestAnalyzer(t *testing.T) {
@@ -19,8 +38,10 @@ func TestAnalyzer(t *testing.T) {
 		".manifest": `{"roots": ["main"]}`,
 		"main/main.rego": `package main
 		import rego.v1
-		main if { data.kubernetes.resources.pods[ns][_].metadata.labels.badlabel == "badbadbad"; r2 }
-		r2 if { data.kubernetes.resources.namespaces["default"].metadata.labels.foo == "bar" }`,
+		main if { data.kubernetes.resources.pods[ns][_].metadata.labels.badlabel == "badbadbad"; r2; r3 }
+		r2 if { data.kubernetes.resources.namespaces["default"].metadata.labels.foo == "bar" }
+		r3 if { data.kubernetes.resources._index.pods.serviceAccount["default"]; r4 }
+		r4 if { data.kubernetes.resources["networking.k8s.io"].ingresses[_][_].spec.rules[_].host == "example.com" }`,
 	}))
 
 	defer s.Stop()
@@ -39,14 +60,15 @@ func TestAnalyzer(t *testing.T) {
 		}
 	}`, s.URL())
 
-	a, err := newAnalyzer(ctx, config, "kubernetes/resources", "main/main", logging.New())
+	a, err := newAnalyzer(ctx, config, "kubernetes/resources", []string{"main/main"}, nil, newPolicyModules(), logging.New())
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	result := <-a.C
-	if len(result.Refs) != 2 || result.Refs[0].Resource != "namespaces" || result.Refs[1].Resource != "pods" {
-		t.Fatalf("expected to identify pods reference but got: %v", result)
+	expected := []ref{{Resource: "namespaces"}, {Resource: "pods"}, {Group: "networking.k8s.io", Resource: "ingresses"}}
+	if !reflect.DeepEqual(result.Refs, expected) {
+		t.Fatalf("expected to identify %v but got: %v", expected, result)
 	}
 
 	if err := a.Stop(ctx); err != nil {
@@ -81,7 +103,7 @@ func TestAnalyzerNoDeps(t *testing.T) {
 		}
 	}`, s.URL())
 
-	a, err := newAnalyzer(ctx, config, "kubernetes/resources", "main/main", logging.New())
+	a, err := newAnalyzer(ctx, config, "kubernetes/resources", []string{"main/main"}, nil, newPolicyModules(), logging.New())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -95,3 +117,563 @@ func TestAnalyzerNoDeps(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// newTestSync returns a Sync replicating into the target, that discovers
+// the given resource types.
+func newTestSync(target opa.Data, rts ...types.ResourceType) *Sync {
+	return &Sync{
+		logger:   logging.New(),
+		target:   target,
+		running:  map[ref]*cancellableSync{},
+		previous: map[ref]<-chan struct{}{},
+		rts:      newResourceTypes(rts...),
+		policies: newPolicyModules(),
+		done:     make(chan struct{}),
+		discover: func() (*resourceTypes, error) {
+			return newResourceTypes(rts...), nil
+		},
+	}
+}
+
+func TestSyncProcessRediscovers(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	widgets := types.ResourceType{Namespaced: true, Group: "example.com", Version: "v1", Resource: "widgets"}
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "example.com", Version: "v1", Resource: "widgets"}: "WidgetList",
+	})
+
+	var discovered []*resourceTypes
+	s := newTestSync(opa.New("", "").Prefix("kubernetes"))
+	s.discover = func() (*resourceTypes, error) {
+		next := discovered[0]
+		discovered = discovered[1:]
+		return next, nil
+	}
+	result := analysisResult{Refs: []ref{{Resource: "widgets"}}}
+
+	// The CRD is not installed yet
+	discovered = append(discovered, newResourceTypes())
+	if s.process(ctx, result, client) {
+		t.Fatal("Expected widgets to be unresolved")
+	}
+
+	// The CRD has been installed since
+	discovered = append(discovered, newResourceTypes(widgets))
+	if !s.process(ctx, result, client) {
+		t.Fatal("Expected widgets to be resolved")
+	}
+	if r, ok := s.running[ref{Resource: "widgets"}]; !ok || r.rt != widgets || len(discovered) != 0 {
+		t.Fatalf("Expected replication of widgets to be started, got: %v", s.running)
+	}
+
+	// Known resources do not trigger discovery
+	if !s.process(ctx, result, client) {
+		t.Fatal("Expected widgets to be resolved")
+	}
+}
+
+func TestSyncStatic(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pods := types.ResourceType{Namespaced: true, Version: "v1", Resource: "pods"}
+	widgets := types.ResourceType{Namespaced: true, Group: "example.com", Version: "v1", Resource: "widgets"}
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Version: "v1", Resource: "pods"}:                          "PodList",
+		{Group: "example.com", Version: "v1", Resource: "widgets"}: "WidgetList",
+	})
+
+	s := newTestSync(opa.New("", "").Prefix("kubernetes"), pods, widgets)
+	s.SetStatic([]string{"pods", "services"})
+
+	// Services are replicated statically, even though they cannot be resolved
+	result := analysisResult{Refs: []ref{{Resource: "pods"}, {Resource: "services"}, {Resource: "widgets"}}}
+	if !s.processAnalysisResult(ctx, result, s.rts, client) {
+		t.Fatal("Expected all resources to be resolved")
+	}
+	if _, ok := s.running[ref{Resource: "widgets"}]; !ok || len(s.running) != 1 {
+		t.Fatalf("Expected only widgets to be replicated dynamically, got: %v", s.running)
+	}
+	expected := []RefStatus{
+		{Ref: "pods", Static: true},
+		{Ref: "services", Static: true},
+		{Ref: "widgets", ResourceType: "example.com/v1/widgets", Namespaced: true, Fields: []string{}},
+	}
+	if !reflect.DeepEqual(s.Status().Refs, expected) {
+		t.Fatalf("Expected %+v but got: %+v", expected, s.Status().Refs)
+	}
+
+	// Resources qualified by a group are replicated into another path
+	result = analysisResult{Refs: []ref{{Resource: "pods"}, {Group: "example.com", Resource: "widgets"}}}
+	s.SetStatic([]string{"pods", "widgets"})
+	if !s.processAnalysisResult(ctx, result, s.rts, client) {
+		t.Fatal("Expected all resources to be resolved")
+	}
+	if _, ok := s.running[ref{Group: "example.com", Resource: "widgets"}]; !ok || len(s.running) != 1 {
+		t.Fatalf("Expected only example.com widgets to be replicated dynamically, got: %v", s.running)
+	}
+}
+
+func TestResourceTypesResolve(t *testing.T) {
+
+	events := types.ResourceType{Namespaced: true, Version: "v1", Resource: "events"}
+	eventsV1 := types.ResourceType{Namespaced: true, Group: "events.k8s.io", Version: "v1", Resource: "events"}
+	certManager := types.ResourceType{Namespaced: true, Group: "cert-manager.io", Version: "v1", Resource: "certificates"}
+	certs := types.ResourceType{Namespaced: false, Group: "certificates.example.com", Version: "v1", Resource: "certificates"}
+	ingresses := types.ResourceType{Namespaced: true, Group: "networking.k8s.io", Version: "v1", Resource: "ingresses"}
+	rts := newResourceTypes(events, eventsV1, certManager, certs, ingresses)
+
+	tests := []struct {
+		ref      ref
+		expected types.ResourceType
+		err      bool
+	}{
+		{ref: ref{Resource: "events"}, expected: events},
+		{ref: ref{Group: "events.k8s.io", Resource: "events"}, expected: eventsV1},
+		{ref: ref{Resource: "ingresses"}, expected: ingresses},
+		{ref: ref{Group: "networking.k8s.io", Resource: "ingresses"}, expected: ingresses},
+		{ref: ref{Group: "cert-manager.io", Resource: "certificates"}, expected: certManager},
+		{ref: ref{Resource: "certificates"}, err: true},
+		{ref: ref{Group: "extensions", Resource: "ingresses"}, err: true},
+		{ref: ref{Resource: "widgets"}, err: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.ref.String(), func(t *testing.T) {
+			rt, err := rts.resolve(tc.ref)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("Expected error but got: %v", rt)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if rt != tc.expected {
+				t.Fatalf("Expected %v but got: %v", tc.expected, rt)
+			}
+		})
+	}
+}
+
+func TestAnalyzeRefsEntrypoints(t *testing.T) {
+
+	compiler := ast.MustCompileModules(map[string]string{
+		"admission.rego": `package admission
+		import rego.v1
+		deny contains msg if { data.kubernetes.pods[_][_].spec.hostNetwork; msg := "host network" }`,
+		"audit.rego": `package audit
+		import rego.v1
+		violations contains name if { some name; data.kubernetes.namespaces[name].metadata.labels.owner == "" }
+		violations contains name if { some ns, name; data.kubernetes.pods[ns][name].spec.hostPID }`,
+	})
+	prefix := ast.MustParseRef("data.kubernetes")
+	entrypoint := func(path string) ast.Ref {
+		ref, err := ast.PtrRef(ast.DefaultRootDocument, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ref
+	}
+
+	result, missing, err := analyzeRefs(compiler, []ast.Ref{entrypoint("admission/deny"), entrypoint("audit/violations")}, prefix, nil, logging.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ref{{Resource: "namespaces"}, {Resource: "pods"}}
+	if len(missing) != 0 || !reflect.DeepEqual(result.Refs, expected) {
+		t.Fatalf("Expected %v but got: %v (missing: %v)", expected, result.Refs, missing)
+	}
+
+	_, missing, err = analyzeRefs(compiler, []ast.Ref{entrypoint("admission/deny"), entrypoint("authz/allow"), entrypoint("audit/missing")}, prefix, nil, logging.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedMissing := []ast.Ref{entrypoint("authz/allow"), entrypoint("audit/missing")}
+	if !reflect.DeepEqual(missing, expectedMissing) {
+		t.Fatalf("Expected missing %v but got: %v", expectedMissing, missing)
+	}
+}
+
+func TestAnalyzeRefsClusters(t *testing.T) {
+
+	compiler := ast.MustCompileModules(map[string]string{
+		"main.rego": `package main
+		import rego.v1
+		deny contains name if { some name; data.kubernetes.pods.ns1[name].spec.hostPID }
+		deny contains name if { some name; data.kubernetes.prod.nodes[name].spec.unschedulable }`,
+	})
+	entry := ast.MustParseRef("data.main.deny")
+
+	result, _, err := analyzeRefs(compiler, []ast.Ref{entry}, ast.MustParseRef("data.kubernetes"), map[string]struct{}{"prod": {}}, logging.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ref{{Resource: "pods"}}
+	if !reflect.DeepEqual(result.Refs, expected) {
+		t.Fatalf("Expected %v but got: %v", expected, result.Refs)
+	}
+}
+
+// policyClient accepts all policies but the ones named "invalid"
+type policyClient struct {
+	opa.Client
+}
+
+func (policyClient) InsertPolicy(id string, _ []byte) error {
+	if id == "invalid" {
+		return errors.New("invalid policy")
+	}
+	return nil
+}
+
+func (policyClient) DeletePolicy(string) error { return nil }
+
+func TestAnalyzerPolicies(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := sdktest.MustNewServer(sdktest.RawBundles(true), sdktest.MockBundle("/bundles/bundle.tar.gz", map[string]string{
+		".manifest": `{"roots": ["main"]}`,
+		"main/main.rego": `package main
+		import rego.v1
+		main if { data.kubernetes.resources.pods[_][_].spec.hostNetwork }`,
+	}))
+
+	defer s.Stop()
+
+	config := fmt.Appendf(nil, `{
+		services: {
+			test: {
+				url: "%v/bundles"
+			}
+		},
+		bundles: {
+			test: {
+				service: test,
+				resource: bundle.tar.gz
+			}
+		}
+	}`, s.URL())
+
+	sync := &Sync{policies: newPolicyModules()}
+	client := sync.Policies(policyClient{})
+
+	a, err := newAnalyzer(ctx, config, "kubernetes/resources", []string{"main/main", "authz/allow"}, nil, sync.policies, logging.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.InsertPolicy("invalid", []byte(`package authz
+	allow if data.kubernetes.resources.nodes[_]`)); err == nil {
+		t.Fatal("Expected error")
+	}
+	if err := client.InsertPolicy("opa/authz/authz.rego", []byte(`package authz
+	allow if data.kubernetes.resources.services[_][_].spec.type == "NodePort"`)); err != nil {
+		t.Fatal(err)
+	}
+
+	result := <-a.C
+	expected := []ref{{Resource: "pods"}, {Resource: "services"}}
+	if !reflect.DeepEqual(result.Refs, expected) {
+		t.Fatalf("expected to identify %v but got: %v", expected, result)
+	}
+}
+
+func TestFieldPaths(t *testing.T) {
+
+	compiler := ast.MustCompileModules(map[string]string{
+		"main.rego": `package main
+		import rego.v1
+		deny contains msg if { data.kubernetes.pods[_][_].metadata.labels.badlabel; msg := "bad label" }
+		deny contains msg if { some ns; p := data.kubernetes.pods[ns][_]; p.spec.containers[_].image == "evil"; msg := "bad image" }
+		deny contains msg if { data.kubernetes.pods[_][_].spec.volumes[0]["hostPath"]; msg := "host path" }
+		deny contains msg if { data.kubernetes.namespaces[_].metadata.labels["example.com/owner"] == ""; msg := "no owner" }
+		deny contains msg if { n := data.kubernetes.nodes[_]; is_tainted(n); msg := "tainted" }
+		deny contains msg if { count(data.kubernetes.services[_]) > 10; msg := "too many services" }
+		is_tainted(n) if { n.spec.taints[_].effect == "NoSchedule" }`,
+	})
+	prefix := ast.MustParseRef("data.kubernetes")
+	entry, err := ast.PtrRef(ast.DefaultRootDocument, "main/deny")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, _, err := analyzeRefs(compiler, []ast.Ref{entry}, prefix, nil, logging.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ref      ref
+		rt       types.ResourceType
+		expected []string
+	}{
+		{
+			ref: ref{Resource: "pods"},
+			rt:  types.ResourceType{Namespaced: true, Version: "v1", Resource: "pods"},
+			expected: []string{
+				`["metadata"]["labels"]["badlabel"]`,
+				`["spec"]["containers"][*]["image"]`,
+				`["spec"]["volumes"][0]["hostPath"]`,
+			},
+		},
+		{
+			ref:      ref{Resource: "namespaces"},
+			rt:       types.ResourceType{Version: "v1", Resource: "namespaces"},
+			expected: []string{`["metadata"]["labels"]["example.com/owner"]`},
+		},
+		{
+			// Objects passed to functions are replicated whole
+			ref: ref{Resource: "nodes"},
+			rt:  types.ResourceType{Version: "v1", Resource: "nodes"},
+		},
+		{
+			// As are objects read as a whole
+			ref: ref{Resource: "services"},
+			rt:  types.ResourceType{Namespaced: true, Version: "v1", Resource: "services"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.ref.String(), func(t *testing.T) {
+			paths := fieldPaths(tc.rt, result.Fields[tc.ref])
+			if len(paths) == 0 && len(tc.expected) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(paths, tc.expected) {
+				t.Fatalf("Expected %v but got: %v", tc.expected, paths)
+			}
+			if _, err := fieldProjection(paths); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestSyncStop(t *testing.T) {
+
+	s := sdktest.MustNewServer(sdktest.RawBundles(true), sdktest.MockBundle("/bundles/bundle.tar.gz", map[string]string{
+		".manifest": `{"roots": ["main"]}`,
+		"main/main.rego": `package main
+		import rego.v1
+		main if { data.kubernetes.resources.widgets[_][_].spec.enabled }`,
+	}))
+
+	defer s.Stop()
+
+	config := fmt.Appendf(nil, `{
+		services: {
+			test: {
+				url: "%v/bundles"
+			}
+		},
+		bundles: {
+			test: {
+				service: test,
+				resource: bundle.tar.gz
+			}
+		}
+	}`, s.URL())
+
+	widgets := types.ResourceType{Namespaced: true, Group: "example.com", Version: "v1", Resource: "widgets"}
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "example.com", Version: "v1", Resource: "widgets"}: "WidgetList",
+	})
+
+	// Shutting down once widgets are replicated keeps their data. The
+	// cleanup, once the policies are analyzed, keeps them too.
+	play := expect.Script{
+		expect.PutData("/").End(),
+	}
+
+	cleanups := make(chan []string, 1)
+	expect.Play(t, play, func(ctx context.Context, target *expect.Client) {
+		sync := newTestSync(target, widgets)
+		sync.SetRemoveData(true)
+		sync.SetCleanup(func(_ context.Context, keep []string) {
+			cleanups <- keep
+		})
+
+		a, err := newAnalyzer(ctx, config, "kubernetes/resources", []string{"main/main"}, nil, sync.policies, logging.New())
+		if err != nil {
+			t.Fatal(err)
+		}
+		go sync.loop(ctx, a, client)
+
+		select {
+		case <-sync.Done():
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timeout waiting for sync to stop")
+		}
+		if len(sync.running) != 0 || sync.Ready() {
+			t.Fatalf("Expected replications to be stopped, got: %v", sync.running)
+		}
+		if _, ok := <-a.C; ok {
+			t.Fatal("Expected analyzer to be stopped")
+		}
+	})
+
+	select {
+	case keep := <-cleanups:
+		if !reflect.DeepEqual(keep, []string{"widgets"}) {
+			t.Fatalf("Expected widgets to be kept, got: %v", keep)
+		}
+	default:
+		t.Fatal("Expected cleanup once widgets are replicated")
+	}
+}
+
+func TestAnalyzerPolicyDir(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "lib"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writePolicy := func(name, policy string) {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(policy), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writePolicy("main.rego", `package main
+	import rego.v1
+	main if { data.kubernetes.resources.pods[_][_].spec.hostNetwork; data.lib.allowed }`)
+	writePolicy("lib/lib.rego", `package lib
+	import rego.v1
+	allowed if data.kubernetes.resources.namespaces[_].metadata.labels.allowed`)
+	writePolicy("README.md", `not a policy`)
+
+	policies := newPolicyModules()
+	dir, err := newPolicyDir(root, policies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go dir.run(ctx)
+
+	a, err := newAnalyzer(ctx, nil, "kubernetes/resources", []string{"main/main"}, nil, policies, logging.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectRefs := func(expected []ref) {
+		t.Helper()
+		for {
+			select {
+			case result := <-a.C:
+				if reflect.DeepEqual(result.Refs, expected) {
+					return
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("Timeout waiting for analysis of %v", expected)
+			}
+		}
+	}
+
+	expectRefs([]ref{{Resource: "namespaces"}, {Resource: "pods"}})
+
+	writePolicy("lib/lib.rego", `package lib
+	import rego.v1
+	allowed if data.kubernetes.resources.nodes[_].metadata.labels.allowed`)
+	expectRefs([]ref{{Resource: "nodes"}, {Resource: "pods"}})
+
+	if err := a.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncStatus(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	widgets := types.ResourceType{Namespaced: true, Group: "example.com", Version: "v1", Resource: "widgets"}
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "example.com", Version: "v1", Resource: "widgets"}: "WidgetList",
+	})
+
+	s := newTestSync(opa.New("", "").Prefix("kubernetes"), widgets)
+	fields := map[ref][]ast.Ref{{Resource: "widgets"}: {ast.MustParseRef("x[_][_].spec.size")[1:]}}
+
+	if !s.process(ctx, analysisResult{Refs: []ref{{Resource: "widgets"}}, Fields: fields}, client) {
+		t.Fatal("Expected widgets to be resolved")
+	}
+	if s.process(ctx, analysisResult{Refs: []ref{{Resource: "gadgets"}, {Resource: "widgets"}}, Fields: fields}, client) {
+		t.Fatal("Expected gadgets to be unresolved")
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/replication", nil))
+
+	var status Status
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Ready || len(status.Refs) != 2 || status.Refs[0].Error == "" {
+		t.Fatalf("Expected gadgets to be reported unresolved, got: %+v", status)
+	}
+	expected := RefStatus{Ref: "widgets", ResourceType: "example.com/v1/widgets", Namespaced: true, Fields: []string{`["spec"]["size"]`}}
+	if !reflect.DeepEqual(status.Refs[1], expected) {
+		t.Fatalf("Expected %+v but got: %+v", expected, status.Refs[1])
+	}
+	if len(status.Replications) != 1 || status.Replications[0].ResourceType != "example.com/v1/widgets" {
+		t.Fatalf("Expected replication of widgets to be reported, got: %+v", status.Replications)
+	}
+}
+
+func TestSyncLinger(t *testing.T) {
+
+	widgets := types.ResourceType{Namespaced: true, Group: "example.com", Version: "v1", Resource: "widgets"}
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "example.com", Version: "v1", Resource: "widgets"}: "WidgetList",
+	})
+	loaded := make(chan struct{})
+	play := expect.Script{
+		expect.PutData("/").Do(func() error {
+			close(loaded)
+			return nil
+		}),
+		expect.PatchData("widgets", "remove").End(),
+	}
+
+	expect.Play(t, play, func(ctx context.Context, target *expect.Client) {
+		s := newTestSync(target, widgets)
+		s.SetLinger(time.Minute)
+		s.SetRemoveData(true)
+
+		needed := analysisResult{Refs: []ref{{Resource: "widgets"}}}
+		s.processAnalysisResult(ctx, needed, s.rts, client)
+		select {
+		case <-loaded:
+		case <-ctx.Done():
+			t.Fatal("Timeout waiting for widgets to be replicated")
+		}
+
+		// Widgets linger once no longer needed, until needed again
+		s.processAnalysisResult(ctx, analysisResult{}, s.rts, client)
+		if r, ok := s.running[ref{Resource: "widgets"}]; !ok || r.stopAt.IsZero() {
+			t.Fatalf("Expected replication of widgets to linger, got: %v", s.running)
+		}
+		if s.expire(time.Now()) == nil {
+			t.Fatal("Expected replication of widgets to be stopped later")
+		}
+		s.processAnalysisResult(ctx, needed, s.rts, client)
+		if r := s.running[ref{Resource: "widgets"}]; !r.stopAt.IsZero() || s.expire(time.Now()) != nil {
+			t.Fatal("Expected replication of widgets to stop lingering")
+		}
+
+		// Lingering widgets are stopped, and their data removed, in time
+		s.processAnalysisResult(ctx, analysisResult{}, s.rts, client)
+		if s.expire(time.Now().Add(time.Hour)) != nil || len(s.running) != 0 {
+			t.Fatalf("Expected replication of widgets to be stopped, got: %v", s.running)
+		}
+		<-ctx.Done()
+	})
+}
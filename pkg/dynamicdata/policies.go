@@ -0,0 +1,142 @@
+// Copyright 2017 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package dynamicdata
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/open-policy-agent/kube-mgmt/internal/policy"
+	"github.com/open-policy-agent/kube-mgmt/pkg/opa"
+
+	//lint:ignore SA1019 using OPA v0.x to ensure backwards compatible with pre-1.0 bundles
+	"github.com/open-policy-agent/opa/ast"
+
+	"github.com/sirupsen/logrus"
+)
+
+// policyModulePrefix prefixes the names of policies loaded into OPA by
+// kube-mgmt, so they do not clash with the modules of bundles.
+const policyModulePrefix = "kube-mgmt/"
+
+// policyModules holds the policies kube-mgmt loaded into OPA itself, e.g.
+// from ConfigMaps, to analyze them along with the bundles.
+type policyModules struct {
+	mu      sync.Mutex
+	modules map[string]*ast.Module
+	changed chan struct{}
+}
+
+func newPolicyModules() *policyModules {
+	return &policyModules{
+		modules: map[string]*ast.Module{},
+		changed: make(chan struct{}, 1),
+	}
+}
+
+func (p *policyModules) insert(id string, bs []byte) {
+	module, err := policy.ParseModule(id, string(bs))
+	if err != nil {
+		logrus.Errorf("Failed to parse policy %v for dynamic data replication analysis: %v", id, err)
+		return
+	}
+	p.mu.Lock()
+	p.modules[id] = module
+	p.mu.Unlock()
+	p.notify()
+}
+
+func (p *policyModules) delete(id string) {
+	p.mu.Lock()
+	_, ok := p.modules[id]
+	delete(p.modules, id)
+	p.mu.Unlock()
+	if ok {
+		p.notify()
+	}
+}
+
+// replace sets the policies whose ids start with prefix to the files, e.g.
+// all the policies of a directory. Policies that fail to parse keep their
+// previous version, like on insert.
+func (p *policyModules) replace(prefix string, files map[string][]byte) {
+	parsed := make(map[string]*ast.Module, len(files))
+	for id, bs := range files {
+		module, err := policy.ParseModule(id, string(bs))
+		if err != nil {
+			logrus.Errorf("Failed to parse policy %v for dynamic data replication analysis: %v", id, err)
+			continue
+		}
+		parsed[id] = module
+	}
+	p.mu.Lock()
+	for id := range p.modules {
+		if _, ok := files[id]; !ok && strings.HasPrefix(id, prefix) {
+			delete(p.modules, id)
+		}
+	}
+	for id, module := range parsed {
+		p.modules[id] = module
+	}
+	p.mu.Unlock()
+	p.notify()
+}
+
+// notify signals a change, without blocking if one is already pending
+func (p *policyModules) notify() {
+	select {
+	case p.changed <- struct{}{}:
+	default:
+	}
+}
+
+// compile returns a compiler for the modules of the bundles along with the
+// policies, or nil if there is nothing to analyze yet.
+func (p *policyModules) compile(bundles *ast.Compiler) (*ast.Compiler, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.modules) == 0 {
+		return bundles, nil
+	}
+	modules := make(map[string]*ast.Module, len(p.modules))
+	if bundles != nil {
+		for name, module := range bundles.Modules {
+			modules[name] = module
+		}
+	}
+	for id, module := range p.modules {
+		modules[policyModulePrefix+id] = module
+	}
+	compiler := ast.NewCompiler()
+	if compiler.Compile(modules); compiler.Failed() {
+		return nil, compiler.Errors
+	}
+	return compiler, nil
+}
+
+// policyRecorder is an opa.Client recording the policies successfully
+// inserted into or deleted from OPA.
+type policyRecorder struct {
+	opa.Client
+	modules *policyModules
+}
+
+// InsertPolicy implements opa.Policies
+func (r *policyRecorder) InsertPolicy(id string, bs []byte) error {
+	if err := r.Client.InsertPolicy(id, bs); err != nil {
+		return err
+	}
+	r.modules.insert(id, bs)
+	return nil
+}
+
+// DeletePolicy implements opa.Policies
+func (r *policyRecorder) DeletePolicy(id string) error {
+	if err := r.Client.DeletePolicy(id); err != nil {
+		return err
+	}
+	r.modules.delete(id)
+	return nil
+}
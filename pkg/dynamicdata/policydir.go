@@ -0,0 +1,105 @@
+// Copyright 2017 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package dynamicdata
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// policyDirPrefix prefixes the ids of the policies loaded from the policy
+// directory, so they do not clash with the policies from ConfigMaps.
+const policyDirPrefix = "policy-dir/"
+
+// policyDir loads the .rego files under a directory into the policies to
+// analyze, and loads them again whenever the directory changes, e.g. when
+// a mounted ConfigMap is updated.
+type policyDir struct {
+	path    string
+	modules *policyModules
+	watcher *fsnotify.Watcher
+}
+
+func newPolicyDir(path string, modules *policyModules) (*policyDir, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	d := &policyDir{path: path, modules: modules, watcher: watcher}
+	if err := d.load(); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// load reads the policies, and watches every directory under the path
+func (d *policyDir) load() error {
+	files := map[string][]byte{}
+	err := filepath.WalkDir(d.path, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			// Skip hidden directories, e.g. the ..<timestamp> directories of
+			// mounted ConfigMaps, which are reached through symlinks already.
+			if path != d.path && strings.HasPrefix(entry.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return d.watcher.Add(path)
+		}
+		if filepath.Ext(path) != ".rego" {
+			return nil
+		}
+		bs, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(d.path, path)
+		if err != nil {
+			return err
+		}
+		files[policyDirPrefix+filepath.ToSlash(rel)] = bs
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	d.modules.replace(policyDirPrefix, files)
+	return nil
+}
+
+// run loads the policies again on every change, until the context is done.
+func (d *policyDir) run(ctx context.Context) {
+	defer d.watcher.Close()
+	for {
+		select {
+		case event, ok := <-d.watcher.Events:
+			if !ok {
+				return
+			}
+			logrus.Debugf("Policy directory changed: %v", event)
+			if err := d.load(); err != nil {
+				logrus.Errorf("Failed to load policies from %v: %v", d.path, err)
+			}
+		case err, ok := <-d.watcher.Errors:
+			if !ok {
+				return
+			}
+			logrus.Errorf("Failed to watch policies in %v: %v", d.path, err)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
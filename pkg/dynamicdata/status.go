@@ -0,0 +1,107 @@
+// Copyright 2017 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package dynamicdata
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Status reports what the analyzer concluded, and what is replicated as a
+// result, to help understand the behaviour of dynamic data replication.
+type Status struct {
+	Ready              bool                `json:"ready"`
+	LastTrigger        *time.Time          `json:"last_trigger,omitempty"`
+	LastAnalysis       *time.Time          `json:"last_analysis,omitempty"`
+	AnalysisError      string              `json:"analysis_error,omitempty"`
+	MissingEntrypoints []string            `json:"missing_entrypoints,omitempty"`
+	Refs               []RefStatus         `json:"refs"`
+	Replications       []ReplicationStatus `json:"replications"`
+}
+
+// RefStatus is a resource referred to by the policies, and the type it
+// resolved to, or the reason it could not be resolved. Resources replicated
+// statically are not resolved.
+type RefStatus struct {
+	Ref          string   `json:"ref"`
+	ResourceType string   `json:"resource_type,omitempty"`
+	Namespaced   bool     `json:"namespaced,omitempty"`
+	Fields       []string `json:"fields,omitempty"`
+	Static       bool     `json:"static,omitempty"`
+	Error        string   `json:"error,omitempty"`
+}
+
+// ReplicationStatus is a running replication.
+type ReplicationStatus struct {
+	Ref          string     `json:"ref"`
+	ResourceType string     `json:"resource_type"`
+	Fields       []string   `json:"fields,omitempty"`
+	Ready        bool       `json:"ready"`
+	StopAt       *time.Time `json:"stop_at,omitempty"` // while lingering
+}
+
+// analyzerStatus is the part of the Status maintained by the analyzer.
+type analyzerStatus struct {
+	lastTrigger  time.Time
+	lastAnalysis time.Time
+	err          error
+	missing      []string
+}
+
+// Status returns the current status of the Sync.
+func (s *Sync) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := Status{
+		Ready:        s.ready,
+		Refs:         append([]RefStatus{}, s.refs...),
+		Replications: []ReplicationStatus{},
+	}
+	if s.analyzer != nil {
+		a := s.analyzer.status()
+		if !a.lastTrigger.IsZero() {
+			status.LastTrigger = &a.lastTrigger
+		}
+		if !a.lastAnalysis.IsZero() {
+			status.LastAnalysis = &a.lastAnalysis
+		}
+		if a.err != nil {
+			status.AnalysisError = a.err.Error()
+		}
+		status.MissingEntrypoints = a.missing
+	}
+	for ref, r := range s.running {
+		replication := ReplicationStatus{
+			Ref:          ref.String(),
+			ResourceType: r.rt.String(),
+			Fields:       r.paths,
+			Ready:        r.sync.Ready(),
+		}
+		if !r.stopAt.IsZero() {
+			stopAt := r.stopAt
+			replication.StopAt = &stopAt
+		}
+		status.Replications = append(status.Replications, replication)
+	}
+	sort.Slice(status.Replications, func(i, j int) bool {
+		return status.Replications[i].Ref < status.Replications[j].Ref
+	})
+	return status
+}
+
+// ServeHTTP reports the Status as JSON.
+func (s *Sync) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(s.Status()); err != nil {
+		logrus.Errorf("Failed to write replication status: %v", err)
+	}
+}
@@ -7,9 +7,11 @@ package opa
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"sort"
 	"strings"
 )
 
@@ -24,6 +26,13 @@ func (err *Error) Error() string {
 	return fmt.Sprintf("code %v: %v", err.Code, err.Message)
 }
 
+// IsNotFoundErr returns true if the err indicates that the document
+// referred to does not exist in OPA.
+func IsNotFoundErr(err error) bool {
+	var opaErr *Error
+	return errors.As(err, &opaErr) && opaErr.Code == "resource_not_found"
+}
+
 // Undefined represents an undefined response from OPA.
 type Undefined struct{}
 
@@ -50,6 +59,21 @@ type Policies interface {
 	DeletePolicy(id string) error
 }
 
+// JSONWriter is implemented by values that can stream their own JSON
+// encoding. PutData writes such values straight into the request body
+// instead of encoding them with encoding/json.
+type JSONWriter interface {
+	WriteJSON(w io.Writer) error
+}
+
+// PatchOp is a single JSON Patch operation. The path is relative to the
+// prefix of the client.
+type PatchOp struct {
+	Op    string       `json:"op"`
+	Path  string       `json:"path"`
+	Value *interface{} `json:"value,omitempty"`
+}
+
 // Data defines the interface for pushing and querying data in OPA.
 type Data interface {
 	Prefix(path string) Data
@@ -58,6 +82,59 @@ type Data interface {
 	PostData(path string, value interface{}) (json.RawMessage, error)
 }
 
+// DataLister is implemented by Data that can list the keys of a document
+// without reading the document itself.
+type DataLister interface {
+	ListData(path string) ([]string, error)
+}
+
+// ListData returns the sorted keys of the document at the path, or none if
+// the document is undefined or not an object. When data is not a
+// DataLister, the whole document is read to find its keys.
+func ListData(data Data, path string) ([]string, error) {
+	if lister, ok := data.(DataLister); ok {
+		return lister.ListData(path)
+	}
+	bs, err := data.PostData(path, nil)
+	if IsUndefinedErr(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(bs, &doc); err != nil {
+		return nil, nil // not an object
+	}
+	keys := make([]string, 0, len(doc))
+	for key := range doc {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// OpsPatcher is implemented by Data that can apply several JSON Patch
+// operations in a single request.
+type OpsPatcher interface {
+	PatchDataOps(ops []PatchOp) error
+}
+
+// PatchDataOps applies the operations in a single request when data is an
+// OpsPatcher, and one at a time otherwise. In the latter case, the
+// operations before a failing one remain applied.
+func PatchDataOps(data Data, ops []PatchOp) error {
+	if patcher, ok := data.(OpsPatcher); ok {
+		return patcher.PatchDataOps(ops)
+	}
+	for _, op := range ops {
+		if err := data.PatchData(op.Path, op.Op, op.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // New returns a new Client object.
 func New(url string, auth string) Client {
 	return &httpClient{strings.TrimRight(url, "/"), "", auth}
@@ -76,7 +153,13 @@ func (c *httpClient) Prefix(path string) Data {
 }
 
 func (c *httpClient) PatchData(path string, op string, value *interface{}) error {
-	buf, err := c.makePatch(path, op, value)
+	return c.PatchDataOps([]PatchOp{{Op: op, Path: path, Value: value}})
+}
+
+// PatchDataOps applies all operations in a single request. OPA applies
+// them atomically: if one operation fails, none of them is applied.
+func (c *httpClient) PatchDataOps(ops []PatchOp) error {
+	buf, err := c.makePatch(ops)
 	if err != nil {
 		return err
 	}
@@ -88,12 +171,10 @@ func (c *httpClient) PatchData(path string, op string, value *interface{}) error
 }
 
 func (c *httpClient) PutData(path string, value interface{}) error {
-	var buf bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(value); err != nil {
-		return err
-	}
+	body := streamJSON(value)
+	defer body.Close()
 	absPath := slashPath("data", c.prefix, path)
-	resp, err := c.do("PUT", absPath, &buf)
+	resp, err := c.do("PUT", absPath, body)
 	if err != nil {
 		return err
 	}
@@ -130,6 +211,53 @@ func (c *httpClient) PostData(path string, value interface{}) (json.RawMessage,
 	return result.Result, nil
 }
 
+// ListData returns the keys of the document at the path, without reading
+// the document itself, or none if the document is undefined.
+func (c *httpClient) ListData(path string) ([]string, error) {
+	ref := "data"
+	for _, segment := range strings.Split(joinPaths("/", c.prefix, path), "/") {
+		if segment == "" {
+			continue
+		}
+		bs, err := json.Marshal(segment)
+		if err != nil {
+			return nil, err
+		}
+		ref += "[" + string(bs) + "]"
+	}
+	var buf bytes.Buffer
+	query := map[string]string{"query": fmt.Sprintf("keys := {k | %v[k]}", ref)}
+	if err := json.NewEncoder(&buf).Encode(query); err != nil {
+		return nil, err
+	}
+	resp, err := c.do("POST", "/query", &buf)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, c.handleErrors(resp)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Result []struct {
+			Keys []interface{} `json:"keys"`
+		} `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, r := range result.Result {
+		for _, key := range r.Keys {
+			if k, ok := key.(string); ok { // arrays have numbers for keys
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
 func (c *httpClient) InsertPolicy(id string, bs []byte) error {
 	buf := bytes.NewBuffer(bs)
 	path := slashPath("policies", id)
@@ -149,17 +277,11 @@ func (c *httpClient) DeletePolicy(id string) error {
 	return c.handleErrors(resp)
 }
 
-func (c *httpClient) makePatch(path, op string, value *interface{}) (io.Reader, error) {
-	patch := []struct {
-		Path  string       `json:"path"`
-		Op    string       `json:"op"`
-		Value *interface{} `json:"value,omitempty"`
-	}{
-		{
-			Path:  slashPath(c.prefix, path),
-			Op:    op,
-			Value: value,
-		},
+func (c *httpClient) makePatch(ops []PatchOp) (io.Reader, error) {
+	patch := make([]PatchOp, 0, len(ops))
+	for _, op := range ops {
+		op.Path = slashPath(c.prefix, op.Path)
+		patch = append(patch, op)
 	}
 	var buf bytes.Buffer
 	if err := json.NewEncoder(&buf).Encode(patch); err != nil {
@@ -168,6 +290,29 @@ func (c *httpClient) makePatch(path, op string, value *interface{}) (io.Reader,
 	return &buf, nil
 }
 
+// streamJSON encodes the value from a separate goroutine into a pipe, so
+// that large documents are sent to OPA without being buffered in memory.
+// Closing the returned reader unblocks the encoder if the request is
+// aborted before the whole body has been read.
+//
+// The body cannot be replayed, so net/http does not retry the request,
+// e.g. on a keep-alive connection closed by OPA, and PutData fails instead,
+// as it does when the value fails to encode. The error is not an *Error:
+// data.GenericSync then reloads all objects into OPA.
+func streamJSON(value interface{}) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		var err error
+		if w, ok := value.(JSONWriter); ok {
+			err = w.WriteJSON(pw)
+		} else {
+			err = json.NewEncoder(pw).Encode(value)
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
 func (c *httpClient) handleErrors(resp *http.Response) error {
 	defer resp.Body.Close()
 	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
@@ -6,9 +6,13 @@ package opa
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestHTTPClientMakePatch(t *testing.T) {
@@ -90,9 +94,217 @@ func TestHTTPClientMakePatch(t *testing.T) {
 
 }
 
+type streamedValue []string
+
+func (v streamedValue) WriteJSON(w io.Writer) error {
+	for i, s := range v {
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if _, err := io.WriteString(w, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestHTTPClientPutData(t *testing.T) {
+
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{
+			value: map[string]interface{}{"a": []int{1, 2, 3}},
+			want:  `{"a": [1, 2, 3]}`,
+		},
+		{
+			value: streamedValue{`{"a": 1`, `"b": 2}`},
+			want:  `{"a": 1, "b": 2}`,
+		},
+	}
+
+	for _, tc := range tests {
+
+		var gotPath string
+		var got interface{}
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotPath = r.URL.Path
+			got = mustUnmarshalJSON(r.Body)
+			w.WriteHeader(http.StatusNoContent)
+		}))
+
+		client := New(ts.URL+"/v1", "").Prefix("kubernetes")
+		if err := client.PutData("pods", tc.value); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		ts.Close()
+
+		var expected interface{}
+		if err := json.Unmarshal([]byte(tc.want), &expected); err != nil {
+			panic(err)
+		}
+
+		if gotPath != "/v1/data/kubernetes/pods" {
+			t.Errorf("Expected path /v1/data/kubernetes/pods but got: %v", gotPath)
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("Expected %v but got: %v", expected, got)
+		}
+	}
+}
+
+// failingValue writes part of a document, then fails
+type failingValue struct{ err error }
+
+func (v failingValue) WriteJSON(w io.Writer) error {
+	if _, err := io.WriteString(w, `{"a": 1`); err != nil {
+		return err
+	}
+	return v.err
+}
+
+// endlessValue writes until the request is aborted, then closes done
+type endlessValue struct{ done chan struct{} }
+
+func (v endlessValue) WriteJSON(w io.Writer) error {
+	defer close(v.done)
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	for {
+		if _, err := io.WriteString(w, `"item",`); err != nil {
+			return err
+		}
+	}
+}
+
+func TestHTTPClientPutDataStreamErrors(t *testing.T) {
+
+	// The connection is closed before the body has been read
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			panic(err)
+		}
+		conn.Close()
+	}))
+	defer ts.Close()
+
+	var opaErr *Error
+	value := endlessValue{done: make(chan struct{})}
+	err := New(ts.URL, "").PutData("pods", value)
+	if err == nil || errors.As(err, &opaErr) {
+		t.Fatalf("Expected a connection error but got: %v", err)
+	}
+	select {
+	case <-value.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the encoder to stop once the request is aborted")
+	}
+
+	// The value fails to encode midway
+	var got []byte
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	boom := errors.New("boom")
+	err = New(ts.URL, "").PutData("pods", failingValue{err: boom})
+	if !errors.Is(err, boom) || errors.As(err, &opaErr) {
+		t.Fatalf("Expected the encoding error but got: %v", err)
+	}
+	if json.Valid(got) {
+		t.Fatalf("Expected OPA not to receive a whole document, got: %s", got)
+	}
+}
+
+func TestMakePatchOps(t *testing.T) {
+
+	client := New("http://localhost", "").Prefix("kubernetes/pods").(*httpClient)
+	var value interface{} = map[string]interface{}{"b": 2}
+
+	buf, err := client.makePatch([]PatchOp{
+		{Op: "remove", Path: "ns/a"},
+		{Op: "add", Path: "ns/b", Value: &value},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var expected interface{}
+	if err := json.Unmarshal([]byte(`[
+		{"op": "remove", "path": "/kubernetes/pods/ns/a"},
+		{"op": "add", "path": "/kubernetes/pods/ns/b", "value": {"b": 2}}
+	]`), &expected); err != nil {
+		panic(err)
+	}
+
+	if result := mustUnmarshalJSON(buf); !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %v but got: %v", expected, result)
+	}
+}
+
+// dataOnly hides the optional interfaces of the Data it wraps
+type dataOnly struct {
+	Data
+}
+
+func TestPatchDataOps(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		client func(url string) Data
+		want   []string
+	}{
+		{
+			name:   "single request",
+			client: func(url string) Data { return New(url, "").Prefix("kubernetes") },
+			want:   []string{`[{"op": "remove", "path": "/kubernetes/a"}, {"op": "remove", "path": "/kubernetes/b"}]`},
+		},
+		{
+			name:   "one request per op",
+			client: func(url string) Data { return dataOnly{New(url, "").Prefix("kubernetes")} },
+			want:   []string{`[{"op": "remove", "path": "/kubernetes/a"}]`, `[{"op": "remove", "path": "/kubernetes/b"}]`},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []interface{}
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = append(got, mustUnmarshalJSON(r.Body))
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer ts.Close()
+
+			ops := []PatchOp{{Op: "remove", Path: "a"}, {Op: "remove", Path: "b"}}
+			if err := PatchDataOps(tc.client(ts.URL+"/v1"), ops); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			var expected []interface{}
+			for _, want := range tc.want {
+				var x interface{}
+				if err := json.Unmarshal([]byte(want), &x); err != nil {
+					panic(err)
+				}
+				expected = append(expected, x)
+			}
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("Expected %v but got: %v", expected, got)
+			}
+		})
+	}
+}
+
 func mustMakePatch(client *httpClient, path, op string, value *interface{}) interface{} {
 
-	buf, err := client.makePatch(path, op, value)
+	buf, err := client.makePatch([]PatchOp{{Op: op, Path: path, Value: value}})
 	if err != nil {
 		panic(err)
 	}
@@ -108,3 +320,55 @@ func mustUnmarshalJSON(r io.Reader) interface{} {
 	}
 	return x
 }
+
+func TestHTTPClientListData(t *testing.T) {
+
+	var gotPath string
+	var got interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		got = mustUnmarshalJSON(r.Body)
+		w.Write([]byte(`{"result": [{"keys": ["pods", "networking.k8s.io", 0]}]}`))
+	}))
+	defer ts.Close()
+
+	keys, err := ListData(New(ts.URL+"/v1", "").Prefix("kubernetes"), "/")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if gotPath != "/v1/query" {
+		t.Errorf("Expected path /v1/query but got: %v", gotPath)
+	}
+	expectedQuery := map[string]interface{}{"query": `keys := {k | data["kubernetes"][k]}`}
+	if !reflect.DeepEqual(got, expectedQuery) {
+		t.Errorf("Expected %v but got: %v", expectedQuery, got)
+	}
+	expected := []string{"networking.k8s.io", "pods"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected %v but got: %v", expected, keys)
+	}
+}
+
+func TestListDataFallback(t *testing.T) {
+
+	var gotPath string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		w.Write([]byte(`{"result": {"pods": {}, "networking.k8s.io": {"ingresses": {}}}}`))
+	}))
+	defer ts.Close()
+
+	keys, err := ListData(dataOnly{New(ts.URL+"/v1", "").Prefix("kubernetes")}, "/")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if gotPath != "/v1/data/kubernetes" {
+		t.Errorf("Expected path /v1/data/kubernetes but got: %v", gotPath)
+	}
+	expected := []string{"networking.k8s.io", "pods"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected %v but got: %v", expected, keys)
+	}
+}
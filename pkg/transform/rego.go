@@ -0,0 +1,104 @@
+// Copyright 2017 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+// Package transform contains transformations applied to Kubernetes objects
+// before they are replicated into OPA.
+package transform
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/open-policy-agent/kube-mgmt/internal/policy"
+
+	//lint:ignore SA1019 using OPA v0.x to ensure backwards compatible with pre-1.0 policies
+	"github.com/open-policy-agent/opa/ast"
+
+	//lint:ignore SA1019 using OPA v0.x to ensure backwards compatible with pre-1.0 policies
+	"github.com/open-policy-agent/opa/rego"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// evalTimeout bounds the time spent transforming a single object.
+const evalTimeout = 5 * time.Second
+
+// Rego transforms objects by calling a Rego function, evaluated locally
+// by an embedded OPA. The function is called with the object as its only
+// argument, and its result is replicated in place of the object. When the
+// function is undefined for an object, the object is not replicated.
+type Rego struct {
+	function string
+	query    rego.PreparedEvalQuery
+}
+
+// NewRego compiles the modules (file name to source) and prepares a call
+// to function, a reference such as `data.transforms.pod`. Modules are
+// parsed as OPA 1.0 would, falling back to the syntax of earlier versions.
+func NewRego(ctx context.Context, function string, modules map[string]string) (*Rego, error) {
+	ref, err := ast.ParseRef(function)
+	if err != nil {
+		return nil, fmt.Errorf("invalid function %q: %w", function, err)
+	}
+	if !ref.HasPrefix(ast.DefaultRootRef) {
+		return nil, fmt.Errorf("invalid function %q: must refer to data", function)
+	}
+
+	// Add the modules in a stable order so errors are reported consistently
+	names := make([]string, 0, len(modules))
+	for name := range modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	opts := []func(*rego.Rego){
+		rego.ParsedQuery(ast.NewBody(ast.NewExpr([]*ast.Term{
+			ast.NewTerm(ref),
+			ast.NewTerm(ast.InputRootRef),
+		}))),
+		// Report failing built-ins instead of silently dropping the object
+		rego.StrictBuiltinErrors(true),
+	}
+	for _, name := range names {
+		module, err := policy.ParseModule(name, modules[name])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %v: %w", name, err)
+		}
+		opts = append(opts, rego.ParsedModule(module))
+	}
+
+	query, err := rego.New(opts...).PrepareForEval(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare function %q: %w", function, err)
+	}
+	return &Rego{function: function, query: query}, nil
+}
+
+// Transform implements data.Transformer
+func (r *Rego) Transform(obj interface{}) (interface{}, error) {
+	if u, ok := obj.(*unstructured.Unstructured); ok {
+		obj = u.Object
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), evalTimeout)
+	defer cancel()
+
+	rs, err := r.query.Eval(ctx, rego.EvalInput(obj))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", r.function, err)
+	}
+	if len(rs) == 0 {
+		return nil, nil
+	}
+	if len(rs) > 1 || len(rs[0].Expressions) != 1 {
+		return nil, fmt.Errorf("%v: expected a single result but got %d", r.function, len(rs))
+	}
+	return rs[0].Expressions[0].Value, nil
+}
+
+func (r *Rego) String() string {
+	return r.function
+}
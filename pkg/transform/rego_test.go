@@ -0,0 +1,98 @@
+package transform
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestRego(t *testing.T) {
+
+	modules := map[string]string{
+		"transform.rego": `package transforms
+
+		pod(obj) := {"name": obj.metadata.name, "images": [c.image | some c in obj.spec.containers]} if {
+			not obj.metadata.labels.skip
+		}`,
+	}
+
+	r, err := NewRego(context.Background(), "data.transforms.pod", modules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "pod1"},
+		"spec": map[string]interface{}{
+			"containers": []interface{}{
+				map[string]interface{}{"image": "nginx"},
+			},
+		},
+	}}
+
+	result, err := r.Transform(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"name": "pod1", "images": []interface{}{"nginx"}}
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatalf("Expected %v but got: %v", expected, result)
+	}
+
+	obj.SetLabels(map[string]string{"skip": "true"})
+	result, err = r.Transform(obj)
+	if err != nil || result != nil {
+		t.Fatalf("Expected object to be dropped but got: %v (err: %v)", result, err)
+	}
+}
+
+func TestRegoV0(t *testing.T) {
+
+	modules := map[string]string{
+		"transform.rego": `package transforms
+
+		pod(obj) = {"name": obj.metadata.name} {
+			not obj.metadata.labels.skip
+		}`,
+	}
+
+	r, err := NewRego(context.Background(), "data.transforms.pod", modules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := r.Transform(map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "pod1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"name": "pod1"}
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatalf("Expected %v but got: %v", expected, result)
+	}
+}
+
+func TestRegoErrors(t *testing.T) {
+
+	if _, err := NewRego(context.Background(), "transforms.pod", nil); err == nil {
+		t.Fatal("Expected error for function outside of data")
+	}
+
+	if _, err := NewRego(context.Background(), "data.transforms.pod", map[string]string{"x.rego": "package transforms\npod(x) := "}); err == nil {
+		t.Fatal("Expected error for invalid module")
+	}
+
+	r, err := NewRego(context.Background(), "data.transforms.pod", map[string]string{
+		"x.rego": `package transforms
+		pod(obj) := obj.a / obj.b`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Transform(map[string]interface{}{"a": 1, "b": 0}); err == nil {
+		t.Fatal("Expected evaluation error")
+	}
+}